@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// capabilityPrefix starts every capability token, which is how Get tells them
+// apart from plain keys.
+const capabilityPrefix = "rvtcap:"
+
+var (
+	errBadCapability     = errors.New("capability is malformed or its signature does not check out")
+	errUnknownOwner      = errors.New("capability is from an owner whose signing key is not pinned")
+	errCapabilityExpired = errors.New("capability has expired")
+	errDigestMismatch    = errors.New("shared object does not match the digest of its capability")
+)
+
+// Capability grants access to a single object of its owner. It names the
+// object the way the owner's peers know it and carries the key that object
+// alone is sealed with, so whoever holds it can fetch and decrypt that object
+// from any node without ever learning the keys of the owner.
+//
+// The owner signs it, so it can't be altered, say to push back its expiry,
+// without the signature breaking. The signature is checked against the key
+// pinned for the owner ID on the node reading it, see FileServerOPts.OwnerKeys,
+// never against a key the token brings along. Since objects are sealed under
+// keys derived from the active key, rotating the key revokes every capability
+// handed out before.
+//
+// Expiry is honoured by the nodes reading the object, and nothing more: the
+// content key is the key the object is sealed with, so whoever held the
+// capability can decrypt the replicas they got hold of for as long as the
+// owner doesn't rotate its key.
+type Capability struct {
+	Owner string
+	// Key is the hashed name of the object, see hashKey.
+	Key string
+	// Digest is the hex encoded SHA-256 of the plaintext.
+	Digest     string
+	ContentKey []byte
+	// Expires is when the capability stops being honoured. The zero time
+	// means never.
+	Expires   time.Time
+	Signature []byte `json:",omitempty"`
+}
+
+func (c Capability) payload() []byte {
+	c.Signature = nil
+	b, _ := json.Marshal(c)
+	return b
+}
+
+func (c *Capability) sign(key ed25519.PrivateKey) {
+	c.Signature = ed25519.Sign(key, c.payload())
+}
+
+// String returns c as a token that can be handed to Get.
+func (c Capability) String() string {
+	b, _ := json.Marshal(c)
+	return capabilityPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func isCapability(token string) bool {
+	return strings.HasPrefix(token, capabilityPrefix)
+}
+
+// ParseCapability decodes a capability token and checks that it is still
+// valid and signed by its owner. ownerKey returns the signing key pinned for
+// an owner ID, if there is one.
+func ParseCapability(token string, ownerKey func(owner string) (ed25519.PublicKey, bool)) (Capability, error) {
+	var c Capability
+	if !isCapability(token) {
+		return c, errBadCapability
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, capabilityPrefix))
+	if err != nil {
+		return c, errBadCapability
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, errBadCapability
+	}
+
+	key, ok := ownerKey(c.Owner)
+	if !ok {
+		return c, errUnknownOwner
+	}
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, c.payload(), c.Signature) {
+		return c, errBadCapability
+	}
+	if !c.Expires.IsZero() && time.Now().After(c.Expires) {
+		return c, errCapabilityExpired
+	}
+
+	return c, nil
+}
+
+// Share returns a capability token for one of our objects, good for ttl or
+// forever if ttl is 0. The object has to be held locally.
+func (s *FileServer) Share(key string, ttl time.Duration) (string, error) {
+	meta, err := s.store.Stat(s.ID, key)
+	if err != nil {
+		return "", err
+	}
+
+	wire := s.wireKey(key)
+	c := Capability{
+		Owner:      s.ID,
+		Key:        wire,
+		Digest:     meta.Checksum,
+		ContentKey: objectKey(s.keys.Active(), wire),
+	}
+	if ttl > 0 {
+		c.Expires = time.Now().Add(ttl).UTC()
+	}
+
+	c.sign(s.keys.SigningKey())
+
+	return c.String(), nil
+}
+
+// OwnerKey returns the key the capabilities of owner are signed with: our
+// own for our own ID, and the one pinned in OwnerKeys for any other.
+func (s *FileServer) OwnerKey(owner string) (ed25519.PublicKey, bool) {
+	if owner == s.ID {
+		return s.keys.SigningKey().Public().(ed25519.PublicKey), true
+	}
+	key, ok := s.OwnerKeys[owner]
+	return key, ok
+}
+
+// getShared reads the object a capability token points at. Nothing is kept
+// locally: the object belongs to someone else.
+func (s *FileServer) getShared(tc TraceContext, token string) (io.Reader, error) {
+	c, err := ParseCapability(token, s.OwnerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.openShared(tc, c.Owner, c.Key, c.ContentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(plaintext)
+	if hex.EncodeToString(hash[:]) != c.Digest {
+		return nil, errDigestMismatch
+	}
+
+	return bytes.NewReader(plaintext), nil
+}
+
+// openShared decrypts the object (id, key) with contentKey, from our own
+// store if we happen to hold a replica of it and from the network otherwise.
+func (s *FileServer) openShared(tc TraceContext, id string, key string, contentKey []byte) ([]byte, error) {
+	var (
+		plaintext []byte
+		found     bool
+	)
+	handle := func(r io.Reader) (int64, error) {
+		buf := new(bytes.Buffer)
+		n, err := copyDecryptWith(newMemoryKeystore(contentKey).Key, r, buf)
+		if err != nil {
+			return 0, err
+		}
+		plaintext, found = buf.Bytes(), true
+		return int64(n), nil
+	}
+
+	if s.store.Has(id, key) {
+		_, r, err := s.store.Read(id, key)
+		if err != nil {
+			return nil, err
+		}
+		_, err = handle(r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if err := s.retrieve(tc, id, key, handle); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("[%s] shared object (%s) not found on the network", s.Transport.Addr(), key)
+	}
+
+	// Convergent objects only point at the shared blob holding the content.
+	br := bufio.NewReader(bytes.NewReader(plaintext))
+	if isConvergentRef(br) {
+		ref, err := readConvergentRef(br)
+		if err != nil {
+			return nil, err
+		}
+		return s.openShared(tc, convergentID, ref.Blob, ref.Key)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCapability(t *testing.T) {
+	owner := NewFileServer(FileServerOPts{Storage: NewMemoryStore()})
+	if _, err := owner.store.Write(owner.ID, "shared.txt", bytes.NewReader([]byte("Foo not bar"))); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := owner.Share("shared.txt", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ParseCapability(token, owner.OwnerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Key == "shared.txt" {
+		t.Errorf("capability leaks the name of the object")
+	}
+
+	// Another node holding the replica can open it with the token alone.
+	replica := new(bytes.Buffer)
+	if _, err := copyEncrypt(objectKey(owner.keys.Active(), c.Key), bytes.NewReader([]byte("Foo not bar")), replica); err != nil {
+		t.Fatal(err)
+	}
+	other := NewFileServer(FileServerOPts{
+		Storage:   NewMemoryStore(),
+		OwnerKeys: map[string]ed25519.PublicKey{owner.ID: owner.keys.SigningKey().Public().(ed25519.PublicKey)},
+	})
+	if _, err := other.store.Write(c.Owner, c.Key, replica); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := other.Get(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if string(b) != "Foo not bar" {
+		t.Errorf("have %q want %q", b, "Foo not bar")
+	}
+
+	// Pushing back the expiry breaks the signature.
+	forged := c
+	forged.Expires = forged.Expires.Add(time.Hour * 24)
+	if _, err := other.Get(forged.String()); err != errBadCapability {
+		t.Errorf("have %v want %v", err, errBadCapability)
+	}
+
+	// So does signing it again under another key than the one pinned for
+	// its owner.
+	_, mallory, _ := ed25519.GenerateKey(nil)
+	resigned := forged
+	resigned.sign(mallory)
+	if _, err := other.Get(resigned.String()); err != errBadCapability {
+		t.Errorf("re-signed: have %v want %v", err, errBadCapability)
+	}
+
+	// Nodes that have no key pinned for the owner don't honour it at all.
+	stranger := NewFileServer(FileServerOPts{Storage: NewMemoryStore()})
+	if _, err := stranger.Get(token); err != errUnknownOwner {
+		t.Errorf("have %v want %v", err, errUnknownOwner)
+	}
+
+	expired := c
+	expired.Expires = time.Now().Add(-time.Minute)
+	expired.sign(owner.keys.SigningKey())
+	if _, err := other.Get(expired.String()); err != errCapabilityExpired {
+		t.Errorf("have %v want %v", err, errCapabilityExpired)
+	}
+
+	// Rotating the key revokes what was shared before.
+	if _, err := owner.keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	token, err = owner.Share("shared.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get(token); err == nil {
+		t.Errorf("capability issued under the new key opened the old replica")
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes of the rvt command.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// errUsage is returned by commands called the wrong way. Their usage has
+// already been printed by then.
+var errUsage = errors.New("usage")
+
+// cli is what every command gets to work with.
+type cli struct {
+	// socketPath is the control socket given on the command line or in
+	// RVT_SOCKET, empty if neither was.
+	socketPath string
+	quiet      bool
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (c *cli) client() *controlClient {
+	if c.socketPath == "" {
+		return newControlClient(defaultSocketPath())
+	}
+	return newControlClient(c.socketPath)
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"daemon", "[--config file]", "run a node in the foreground", runDaemon},
+		{"put", "<file> [--key key] [--ttl duration]", "store a file, - reads stdin", runPut},
+		{"get", "<key> [-o file]", "fetch an object, to stdout unless -o is given", runGet},
+		{"rm", "<key>", "delete an object from the node and its peers", runRm},
+		{"ls", "[--prefix prefix] [--limit n]", "list objects", runLs},
+		{"stat", "<key>", "show the metadata of an object", runStat},
+		{"status", "", "show who the node is and what it is doing", runStatus},
+		{"peers", "", "list the peers of the node", runPeers},
+	}
+}
+
+// run runs the rvt command line args, reading stdin and printing to stdout
+// and stderr, and returns its exit code.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+
+	fs := flag.NewFlagSet("rvt", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.StringVar(&c.socketPath, "socket", "", "control socket of the local node (default $RVT_SOCKET or "+defaultSocketPath()+")")
+	fs.BoolVar(&c.quiet, "q", false, "don't show progress")
+	fs.Usage = func() { usage(c.stderr, fs) }
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if c.socketPath == "" {
+		c.socketPath = os.Getenv("RVT_SOCKET")
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	name := fs.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		err := cmd.run(c, fs.Args()[1:])
+		switch {
+		case err == nil:
+			return exitOK
+		case errors.Is(err, errUsage):
+			return exitUsage
+		}
+		fmt.Fprintf(c.stderr, "rvt %s: %s\n", name, err)
+		return exitError
+	}
+
+	fmt.Fprintf(c.stderr, "rvt: unknown command %q\n", name)
+	fs.Usage()
+	return exitUsage
+}
+
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: rvt [-socket path] [-q] <command> [arguments]\n\ncommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nflags:\n")
+	fs.PrintDefaults()
+}
+
+// commandFlags returns the flag set of a command.
+func (c *cli) commandFlags(cmd string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: rvt %s %s\n", cmd, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses args with fs, letting flags come after the positional
+// arguments as well, and checks that exactly n of those were given.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if len(positional) != n {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+func runPut(c *cli, args []string) error {
+	fs := c.commandFlags("put", "<file> [--key key] [--ttl duration]")
+	key := fs.String("key", "", "key to store the file under (default the file name)")
+	ttl := fs.Duration("ttl", 0, "how long the object is kept (default forever)")
+
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	path := pos[0]
+
+	var (
+		r    io.Reader = c.stdin
+		size int64     = -1
+	)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", path)
+		}
+		r, size = f, info.Size()
+
+		if *key == "" {
+			*key = filepath.Base(path)
+		}
+	}
+	if *key == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	p := c.progress("put "+*key, size)
+	meta, err := c.client().put(*key, p.reader(r), *ttl)
+	p.done(err)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.stdout, meta.Key)
+	return nil
+}
+
+func runGet(c *cli, args []string) error {
+	fs := c.commandFlags("get", "<key> [-o file]")
+	out := fs.String("o", "", "file to write the object to (default stdout)")
+
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	key := pos[0]
+
+	body, size, err := c.client().get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if *out == "" || *out == "-" {
+		p := c.progress("get "+key, size)
+		_, err := io.Copy(c.stdout, p.reader(body))
+		p.done(err)
+		return err
+	}
+
+	// Write next to the destination first, so a failed fetch doesn't leave
+	// half a file behind, or clobber the one that was there.
+	tmp, err := os.CreateTemp(filepath.Dir(*out), "."+filepath.Base(*out)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	p := c.progress("get "+key, size)
+	_, err = io.Copy(tmp, p.reader(body))
+	p.done(err)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), *out)
+}
+
+func runRm(c *cli, args []string) error {
+	fs := c.commandFlags("rm", "<key>")
+
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	return c.client().remove(pos[0])
+}
+
+func runLs(c *cli, args []string) error {
+	fs := c.commandFlags("ls", "[--prefix prefix] [--limit n]")
+	prefix := fs.String("prefix", "", "only list keys starting with prefix")
+	limit := fs.Int("limit", 0, "list at most n keys (default all of them)")
+
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	client := c.client()
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	defer tw.Flush()
+
+	opts := ListOpts{Prefix: *prefix}
+	listed := 0
+	for {
+		if *limit > 0 {
+			opts.Limit = *limit - listed
+		}
+
+		res, err := client.list(opts)
+		if err != nil {
+			return err
+		}
+		for _, meta := range res.Entries {
+			fmt.Fprintf(tw, "%d\t %s\t %s\n", meta.Size, meta.Created.Local().Format(time.DateTime), meta.Key)
+		}
+		listed += len(res.Entries)
+
+		if res.Next == "" || (*limit > 0 && listed >= *limit) {
+			return nil
+		}
+		opts.After = res.Next
+	}
+}
+
+func runStat(c *cli, args []string) error {
+	fs := c.commandFlags("stat", "<key>")
+
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	meta, err := c.client().stat(pos[0])
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(tw, "key:\t%s\n", meta.Key)
+	fmt.Fprintf(tw, "size:\t%d\n", meta.Size)
+	if meta.ContentType != "" {
+		fmt.Fprintf(tw, "type:\t%s\n", meta.ContentType)
+	}
+	fmt.Fprintf(tw, "checksum:\t%s\n", meta.Checksum)
+	fmt.Fprintf(tw, "created:\t%s\n", meta.Created.Local().Format(time.RFC3339))
+	fmt.Fprintf(tw, "version:\t%d\n", meta.Version)
+	if !meta.Expires.IsZero() {
+		fmt.Fprintf(tw, "expires:\t%s\n", meta.Expires.Local().Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func runStatus(c *cli, args []string) error {
+	fs := c.commandFlags("status", "")
+
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	st, err := c.client().status()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(tw, "id:\t%s\n", st.ID)
+	fmt.Fprintf(tw, "node:\t%s\n", st.NodeID)
+	fmt.Fprintf(tw, "listen:\t%s\n", st.Addr)
+	fmt.Fprintf(tw, "signing key:\t%s\n", base64.StdEncoding.EncodeToString(st.SigningKey))
+	if !st.Started.IsZero() {
+		fmt.Fprintf(tw, "uptime:\t%s\n", st.Uptime.Round(time.Second))
+	}
+	fmt.Fprintf(tw, "peers:\t%d\n", len(st.Peers))
+	fmt.Fprintf(tw, "stored:\t%d objects, %s\n", st.Objects, humanBytes(st.Bytes))
+	owners := make([]string, 0, len(st.Usage))
+	for owner := range st.Usage {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		fmt.Fprintf(tw, "held for %s:\t%s\n", owner, humanBytes(st.Usage[owner]))
+	}
+	fmt.Fprintf(tw, "operations:\t%d\n", st.Operations)
+	return tw.Flush()
+}
+
+func runPeers(c *cli, args []string) error {
+	fs := c.commandFlags("peers", "")
+
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	peers, err := c.client().peers()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tDIRECTION\tCONNECTED\tRECEIVED\tSENT\tSTREAMS")
+	for _, p := range peers {
+		direction := "inbound"
+		if p.Outbound {
+			direction = "outbound"
+		}
+		connected := "-"
+		if !p.ConnectedSince.IsZero() {
+			connected = p.ConnectedSince.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", p.Addr, direction, connected, humanBytes(p.BytesReceived), humanBytes(p.BytesSent), p.Streams)
+	}
+	return tw.Flush()
+}
+
+// progress reports how far a transfer got on stderr, as long as stderr is a
+// terminal and -q was not given.
+type progress struct {
+	w     io.Writer
+	label string
+	total int64
+	n     int64
+	last  time.Time
+}
+
+func (c *cli) progress(label string, total int64) *progress {
+	p := &progress{label: label, total: total}
+	if c.quiet {
+		return p
+	}
+	if f, ok := c.stderr.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			p.w = f
+		}
+	}
+	return p
+}
+
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p.w == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+func (p *progress) add(n int) {
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= 100*time.Millisecond {
+		p.last = now
+		p.print()
+	}
+}
+
+func (p *progress) print() {
+	if p.total >= 0 {
+		pct := 100
+		if p.total > 0 {
+			pct = int(p.n * 100 / p.total)
+		}
+		fmt.Fprintf(p.w, "\r%s  %s / %s (%d%%)\033[K", p.label, humanBytes(p.n), humanBytes(p.total), pct)
+		return
+	}
+	fmt.Fprintf(p.w, "\r%s  %s\033[K", p.label, humanBytes(p.n))
+}
+
+// done ends the progress line.
+func (p *progress) done(err error) {
+	if p.w == nil {
+		return
+	}
+	p.print()
+	if err != nil {
+		fmt.Fprintln(p.w, "  failed")
+		return
+	}
+	fmt.Fprintln(p.w)
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
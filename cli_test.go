@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+// rvt runs the command line args against the node listening on socket,
+// feeding it stdin, and returns its exit code and what it printed to stdout.
+func rvt(socket string, stdin string, args ...string) (int, string) {
+	out := new(bytes.Buffer)
+	code := run(append([]string{"-socket", socket, "-q"}, args...), strings.NewReader(stdin), out, io.Discard)
+	return code, out.String()
+}
+
+func TestRun(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:   NewMemoryStore(),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+
+	socket := filepath.Join(t.TempDir(), "rvt.sock")
+	control := NewControl(ControlOpts{SocketPath: socket, Server: s})
+	go control.ListenAndServe()
+	defer control.Close()
+	waitFor(t, "the control socket", func() bool {
+		_, err := newControlClient(socket).list(ListOpts{})
+		return err == nil
+	})
+
+	file := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(file, []byte("Foo not bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The steps run in order, against the same node.
+	steps := []struct {
+		name  string
+		stdin string
+		args  []string
+		code  int
+		out   string
+	}{
+		{"no command", "", nil, exitUsage, ""},
+		{"unknown command", "", []string{"frobnicate"}, exitUsage, ""},
+		{"help", "", []string{"-h"}, exitOK, ""},
+		{"put", "", []string{"put", file}, exitOK, "notes.txt\n"},
+		{"put under a key", "", []string{"put", file, "--key", "copy.txt"}, exitOK, "copy.txt\n"},
+		{"put stdin", "from stdin", []string{"put", "-", "--key", "piped"}, exitOK, "piped\n"},
+		{"put stdin without a key", "from stdin", []string{"put", "-"}, exitUsage, ""},
+		{"put nothing", "", []string{"put"}, exitUsage, ""},
+		{"put a missing file", "", []string{"put", file + ".missing"}, exitError, ""},
+		{"put a directory", "", []string{"put", filepath.Dir(file)}, exitError, ""},
+		{"get stdin", "", []string{"get", "piped"}, exitOK, "from stdin"},
+		{"get", "", []string{"get", "notes.txt"}, exitOK, "Foo not bar"},
+		{"rm", "", []string{"rm", "copy.txt"}, exitOK, ""},
+		{"rm again", "", []string{"rm", "copy.txt"}, exitError, ""},
+		{"rm nothing", "", []string{"rm"}, exitUsage, ""},
+		{"rm two keys", "", []string{"rm", "notes.txt", "piped"}, exitUsage, ""},
+		{"get removed", "", []string{"get", "copy.txt"}, exitError, ""},
+		{"ls bad flag", "", []string{"ls", "--limit", "many"}, exitUsage, ""},
+	}
+
+	for _, step := range steps {
+		code, out := rvt(socket, step.stdin, step.args...)
+		if code != step.code {
+			t.Errorf("%s: exit code %d want %d", step.name, code, step.code)
+		}
+		if out != step.out {
+			t.Errorf("%s: printed %q want %q", step.name, out, step.out)
+		}
+	}
+
+	// Nothing can be reached without a node.
+	code, _ := rvt(filepath.Join(t.TempDir(), "none.sock"), "", "ls")
+	if code != exitError {
+		t.Errorf("no node: exit code %d want %d", code, exitError)
+	}
+}
+
+func TestRunLsPages(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+
+	// A node handing out at most two entries per page.
+	var (
+		mu     sync.Mutex
+		limits []int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /objects", func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		mu.Lock()
+		limits = append(limits, limit)
+		mu.Unlock()
+		if limit == 0 || limit > 2 {
+			limit = 2
+		}
+
+		var res ListResult
+		for _, key := range keys {
+			if key <= r.URL.Query().Get("after") {
+				continue
+			}
+			if len(res.Entries) == limit {
+				res.Next = res.Entries[len(res.Entries)-1].Key
+				break
+			}
+			res.Entries = append(res.Entries, Metadata{Key: key, Size: 1, Created: time.Now()})
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+
+	socket := filepath.Join(t.TempDir(), "rvt.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	listed := func(out string) []string {
+		var keys []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			fields := strings.Fields(line)
+			keys = append(keys, fields[len(fields)-1])
+		}
+		return keys
+	}
+
+	for _, tc := range []struct {
+		args   []string
+		keys   string
+		limits []int
+	}{
+		{[]string{"ls"}, "a b c d e", []int{0, 0, 0}},
+		{[]string{"ls", "--limit", "3"}, "a b c", []int{3, 1}},
+		{[]string{"ls", "--limit", "2"}, "a b", []int{2}},
+	} {
+		mu.Lock()
+		limits = nil
+		mu.Unlock()
+
+		code, out := rvt(socket, "", tc.args...)
+		if code != exitOK {
+			t.Errorf("%v: exit code %d want %d", tc.args, code, exitOK)
+		}
+		if have := strings.Join(listed(out), " "); have != tc.keys {
+			t.Errorf("%v: listed %q want %q", tc.args, have, tc.keys)
+		}
+		mu.Lock()
+		if !slices.Equal(limits, tc.limits) {
+			t.Errorf("%v: asked for pages of %v want %v", tc.args, limits, tc.limits)
+		}
+		mu.Unlock()
+	}
+}
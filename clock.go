@@ -0,0 +1,107 @@
+package main
+
+// VectorClock counts the writes each node made to a key, as far as the node
+// writing a version knew. Comparing two of them tells whether one version was
+// written knowing about the other, or whether they were written concurrently
+// and are in conflict.
+type VectorClock map[string]uint64
+
+// clockOrder is how two vector clocks relate.
+type clockOrder int
+
+const (
+	clockEqual clockOrder = iota
+	clockBefore
+	clockAfter
+	clockConcurrent
+)
+
+func (c VectorClock) copy() VectorClock {
+	out := make(VectorClock, len(c)+1)
+	for node, n := range c {
+		out[node] = n
+	}
+	return out
+}
+
+// tick returns a copy of c counting one more write by node.
+func (c VectorClock) tick(node string) VectorClock {
+	out := c.copy()
+	out[node]++
+	return out
+}
+
+// merge returns a copy of c counting, for every node, as many writes as
+// whichever of c and o counts more of them.
+func (c VectorClock) merge(o VectorClock) VectorClock {
+	out := c.copy()
+	for node, n := range o {
+		if n > out[node] {
+			out[node] = n
+		}
+	}
+	return out
+}
+
+// compare tells how c relates to o.
+func (c VectorClock) compare(o VectorClock) clockOrder {
+	var less, more bool
+	for node, n := range c {
+		if n > o[node] {
+			more = true
+		}
+	}
+	for node, n := range o {
+		if n > c[node] {
+			less = true
+		}
+	}
+
+	switch {
+	case less && more:
+		return clockConcurrent
+	case less:
+		return clockBefore
+	case more:
+		return clockAfter
+	}
+	return clockEqual
+}
+
+// ConflictResolver settles two versions of a key written concurrently. It
+// returns the one that stays the current version, and whether the other is
+// kept as a sibling rather than filed away with the superseded versions,
+// where the version policy may prune it.
+//
+// Every node holding the key runs it, in whatever order the versions reach
+// that node, so it has to settle on the same winner given the two versions
+// either way round.
+type ConflictResolver func(a Metadata, b Metadata) (winner Metadata, keepSibling bool)
+
+// LastWriterWins keeps the version written last. The other one ends up with
+// the superseded versions.
+func LastWriterWins(a Metadata, b Metadata) (Metadata, bool) {
+	return lastWritten(a, b), false
+}
+
+// KeepSiblings keeps the version written last current, and the other one as a
+// sibling, see FileServer.Siblings.
+func KeepSiblings(a Metadata, b Metadata) (Metadata, bool) {
+	return lastWritten(a, b), true
+}
+
+// lastWritten returns the version written last, going by version number and
+// then by the node that wrote it, so that the pick does not depend on the
+// order of a and b.
+func lastWritten(a Metadata, b Metadata) Metadata {
+	if a.Version != b.Version {
+		if a.Version > b.Version {
+			return a
+		}
+		return b
+	}
+	if a.Node > b.Node {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestVectorClock(t *testing.T) {
+	base := VectorClock{}.tick("a")
+	left := base.tick("a")
+	right := base.tick("b")
+
+	cases := []struct {
+		name string
+		c, o VectorClock
+		want clockOrder
+	}{
+		{"equal", base, base.copy(), clockEqual},
+		{"before", base, left, clockBefore},
+		{"after", left, base, clockAfter},
+		{"concurrent", left, right, clockConcurrent},
+		{"merged", left, VectorClock{"a": 2, "b": 1}, clockBefore},
+		{"merge", left.merge(right), VectorClock{"a": 2, "b": 1}, clockEqual},
+		{"merge then tick", left.merge(right).tick("b"), right, clockAfter},
+	}
+
+	for _, tc := range cases {
+		if have := tc.c.compare(tc.o); have != tc.want {
+			t.Errorf("%s: have %d want %d", tc.name, have, tc.want)
+		}
+	}
+
+	if base["a"] != 1 || len(base) != 1 {
+		t.Errorf("tick changed the clock it was called on: %v", base)
+	}
+}
+
+func TestResolversAgree(t *testing.T) {
+	a := Metadata{Version: 10, Node: "a"}
+	b := Metadata{Version: 10, Node: "b"}
+	c := Metadata{Version: 11, Node: "a"}
+
+	for _, resolve := range []ConflictResolver{LastWriterWins, KeepSiblings} {
+		for _, pair := range [][2]Metadata{{a, b}, {a, c}, {b, c}} {
+			x, _ := resolve(pair[0], pair[1])
+			y, _ := resolve(pair[1], pair[0])
+			if x.Node != y.Node || x.Version != y.Version {
+				t.Errorf("winner depends on the order: %+v and %+v", x, y)
+			}
+		}
+	}
+
+	if winner, _ := LastWriterWins(a, c); winner.Version != 11 {
+		t.Errorf("have version %d want 11", winner.Version)
+	}
+}
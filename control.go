@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The control API is how the rvt command, and any other process on the same
+// machine, talks to a running node: plain HTTP, served over a Unix socket only
+// the user running the node can connect to and, optionally, on a loopback
+// address for clients that can't speak to a socket.
+//
+//	PUT    /objects/{key}   stores the request body, ?ttl= sets a TTL
+//	GET    /objects/{key}   streams the object back
+//	DELETE /objects/{key}   deletes the object everywhere
+//	GET    /objects         lists objects, ?prefix= ?after= ?limit=
+//	GET    /stat/{key}      returns the metadata of the object
+//	GET    /peers           lists the connected peers, see PeerStatus
+//	GET    /status          tells who the node is and what it does, see Status
+//
+// Object bodies are streamed both ways, and may be sent chunked. Keys are path
+// escaped as a whole, slashes included. Errors come back as a plain text
+// body.
+
+// defaultSocketName is the socket the control API listens on in
+// defaultSocketDir unless told otherwise.
+const defaultSocketName = "rvt.sock"
+
+func defaultSocketPath() string {
+	return filepath.Join(defaultSocketDir(), defaultSocketName)
+}
+
+// defaultSocketDir is a directory of the user's own: under $XDG_RUNTIME_DIR,
+// or in the temp directory, shared with every other user, without it.
+func defaultSocketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "rvt")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("rvt-%d", os.Getuid()))
+}
+
+// checkPrivateDir makes sure only we can get into dir, so that nobody else
+// can have put a socket of theirs there.
+func checkPrivateDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || fi.Mode().Perm()&0077 != 0 || !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is open to other users, or not ours", dir)
+	}
+	return nil
+}
+
+type ControlOpts struct {
+	// SocketPath is the Unix socket the control API listens on.
+	SocketPath string
+	// HTTPAddr turns on serving the control API on a TCP address as well. It
+	// has to be a loopback address: there is no authentication beyond being
+	// on the machine, and unlike the socket, any local user can connect.
+	HTTPAddr string
+	Server   *FileServer
+}
+
+// Control serves the control API of a FileServer.
+type Control struct {
+	ControlOpts
+
+	mux     *http.ServeMux
+	srv     *http.Server
+	httpSrv *http.Server
+
+	addrLock sync.Mutex
+	httpAddr net.Addr
+}
+
+func NewControl(opts ControlOpts) *Control {
+	if len(opts.SocketPath) == 0 {
+		opts.SocketPath = defaultSocketPath()
+	}
+
+	c := &Control{
+		ControlOpts: opts,
+		mux:         http.NewServeMux(),
+	}
+	c.srv = &http.Server{Handler: c.mux}
+	c.httpSrv = &http.Server{Handler: loopbackOnly(c.mux)}
+
+	c.mux.HandleFunc("PUT /objects/{key...}", c.handlePut)
+	c.mux.HandleFunc("GET /objects/{key...}", c.handleGet)
+	c.mux.HandleFunc("DELETE /objects/{key...}", c.handleDelete)
+	c.mux.HandleFunc("GET /objects", c.handleList)
+	c.mux.HandleFunc("GET /stat/{key...}", c.handleStat)
+	c.mux.HandleFunc("GET /peers", c.handlePeers)
+	c.mux.HandleFunc("GET /status", c.handleStatus)
+
+	return c
+}
+
+func (c *Control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on the control socket, and on HTTPAddr if set, and
+// serves requests until Close is called. A socket left behind by a node that
+// is gone is replaced, one a live node still answers on is not.
+func (c *Control) ListenAndServe() error {
+	var httpLn net.Listener
+	if c.HTTPAddr != "" {
+		if err := checkLoopback(c.HTTPAddr); err != nil {
+			return fmt.Errorf("control API: %w", err)
+		}
+		ln, err := net.Listen("tcp", c.HTTPAddr)
+		if err != nil {
+			return err
+		}
+		httpLn = ln
+
+		c.addrLock.Lock()
+		c.httpAddr = ln.Addr()
+		c.addrLock.Unlock()
+	}
+
+	ln, err := c.listenSocket()
+	if err != nil {
+		if httpLn != nil {
+			httpLn.Close()
+		}
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- c.srv.Serve(ln)
+	}()
+	if httpLn != nil {
+		go func() {
+			errc <- c.httpSrv.Serve(httpLn)
+		}()
+	}
+
+	// Either one failing takes the other one down with it.
+	err = <-errc
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	c.Close()
+	return err
+}
+
+func (c *Control) listenSocket() (net.Listener, error) {
+	dir := filepath.Dir(c.SocketPath)
+	if dir == defaultSocketDir() {
+		if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if err := checkPrivateDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if conn, err := net.Dial("unix", c.SocketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use by another node", c.SocketPath)
+	}
+	if err := os.Remove(c.SocketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// The socket is made in a directory of its own first, and only moved
+	// into place once nobody else can connect to it.
+	tmp, err := os.MkdirTemp(dir, ".rvt-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, defaultSocketName)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Close removes the socket where it ends up instead.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(path, 0600); err == nil {
+		err = os.Rename(path, c.SocketPath)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Addr returns the address the control API is served on over TCP, nil until
+// it is listening there.
+func (c *Control) Addr() net.Addr {
+	c.addrLock.Lock()
+	defer c.addrLock.Unlock()
+	return c.httpAddr
+}
+
+// Close stops serving and removes the socket.
+func (c *Control) Close() error {
+	err := c.srv.Close()
+	if herr := c.httpSrv.Close(); err == nil {
+		err = herr
+	}
+	os.Remove(c.SocketPath)
+	return err
+}
+
+// checkLoopback makes sure addr, a host:port, only listens on the loopback
+// interface.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("%s is not a loopback address", addr)
+}
+
+// loopbackOnly turns away requests naming a host other than a loopback one,
+// so a web page can't get a browser to talk to the node by pointing a name it
+// controls at 127.0.0.1.
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if checkLoopback(net.JoinHostPort(host, "0")) != nil {
+			http.Error(w, "control API is only served to loopback hosts", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestKey returns the key a request is about.
+func requestKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+func (c *Control) handlePut(w http.ResponseWriter, r *http.Request) {
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+
+	var opts PutOpts
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 0 {
+			http.Error(w, "bad ttl "+strconv.Quote(ttl), http.StatusBadRequest)
+			return
+		}
+		opts.TTL = d
+	}
+
+	if err := c.Server.StoreWithOpts(key, r.Body, opts); err != nil {
+		writeControlError(w, err)
+		return
+	}
+
+	meta, err := c.Server.Stat(key)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, http.StatusCreated, meta)
+}
+
+func (c *Control) handleGet(w http.ResponseWriter, r *http.Request) {
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+
+	rd, err := c.Server.Get(key)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	if rc, ok := rd.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	// Capabilities are never kept locally, so there is nothing to stat.
+	if meta, err := c.Server.Stat(key); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+		if meta.ContentType != "" {
+			w.Header().Set("Content-Type", meta.ContentType)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, rd)
+}
+
+func (c *Control) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := c.Server.Stat(key); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	if err := c.Server.Delete(key); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Control) handleList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := ListOpts{
+		Prefix: q.Get("prefix"),
+		After:  q.Get("after"),
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			http.Error(w, "bad limit "+strconv.Quote(limit), http.StatusBadRequest)
+			return
+		}
+		opts.Limit = n
+	}
+
+	res, err := c.Server.List(c.Server.ID, opts)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, http.StatusOK, res)
+}
+
+func (c *Control) handleStat(w http.ResponseWriter, r *http.Request) {
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+
+	meta, err := c.Server.Stat(key)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, http.StatusOK, meta)
+}
+
+func (c *Control) handlePeers(w http.ResponseWriter, r *http.Request) {
+	st, err := c.Server.Status()
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, http.StatusOK, st.Peers)
+}
+
+func (c *Control) handleStatus(w http.ResponseWriter, r *http.Request) {
+	st, err := c.Server.Status()
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, http.StatusOK, st)
+}
+
+func writeControlJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeControlError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, errBadCapability), errors.Is(err, errCapabilityExpired):
+		status = http.StatusForbidden
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// controlClient talks to the control API of a local node.
+type controlClient struct {
+	http *http.Client
+}
+
+func newControlClient(socketPath string) *controlClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			// Whoever answers on the default socket has to be us.
+			if dir := filepath.Dir(socketPath); dir == defaultSocketDir() {
+				if err := checkPrivateDir(dir); err != nil {
+					return nil, err
+				}
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &controlClient{http: &http.Client{Transport: transport}}
+}
+
+// controlError is an error reported by the node.
+type controlError struct {
+	Status  int
+	Message string
+}
+
+func (e *controlError) Error() string {
+	return e.Message
+}
+
+// Is makes a missing object match os.ErrNotExist.
+func (e *controlError) Is(target error) bool {
+	return target == os.ErrNotExist && e.Status == http.StatusNotFound
+}
+
+func (c *controlClient) do(method string, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := "http://rvt" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("can't reach the node, is it running? %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &controlError{
+			Status:  resp.StatusCode,
+			Message: strings.TrimSpace(string(b)),
+		}
+	}
+	return resp, nil
+}
+
+func (c *controlClient) doJSON(method string, path string, query url.Values, body io.Reader, v any) error {
+	resp, err := c.do(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func objectPath(key string) string {
+	return "/objects/" + url.PathEscape(key)
+}
+
+func (c *controlClient) put(key string, r io.Reader, ttl time.Duration) (Metadata, error) {
+	var query url.Values
+	if ttl > 0 {
+		query = url.Values{"ttl": {ttl.String()}}
+	}
+
+	var meta Metadata
+	err := c.doJSON(http.MethodPut, objectPath(key), query, r, &meta)
+	return meta, err
+}
+
+// get returns the object and its size, -1 if the node did not tell.
+func (c *controlClient) get(key string) (io.ReadCloser, int64, error) {
+	resp, err := c.do(http.MethodGet, objectPath(key), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (c *controlClient) remove(key string) error {
+	return c.doJSON(http.MethodDelete, objectPath(key), nil, nil, nil)
+}
+
+func (c *controlClient) list(opts ListOpts) (ListResult, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.After != "" {
+		query.Set("after", opts.After)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	var res ListResult
+	err := c.doJSON(http.MethodGet, "/objects", query, nil, &res)
+	return res, err
+}
+
+func (c *controlClient) stat(key string) (Metadata, error) {
+	var meta Metadata
+	err := c.doJSON(http.MethodGet, "/stat/"+url.PathEscape(key), nil, nil, &meta)
+	return meta, err
+}
+
+func (c *controlClient) status() (Status, error) {
+	var st Status
+	err := c.doJSON(http.MethodGet, "/status", nil, nil, &st)
+	return st, err
+}
+
+func (c *controlClient) peers() ([]PeerStatus, error) {
+	var peers []PeerStatus
+	err := c.doJSON(http.MethodGet, "/peers", nil, nil, &peers)
+	return peers, err
+}
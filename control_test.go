@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+func TestControl(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:   NewMemoryStore(),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+
+	socket := filepath.Join(t.TempDir(), "rvt.sock")
+	control := NewControl(ControlOpts{SocketPath: socket, Server: s})
+	go control.ListenAndServe()
+	defer control.Close()
+
+	client := newControlClient(socket)
+	for i := 0; i < 50; i++ {
+		if _, err := client.list(ListOpts{}); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	key := "notes/2024 q1.txt"
+	data := "not much happened"
+
+	meta, err := client.put(key, strings.NewReader(data), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Key != key || meta.Size != int64(len(data)) || meta.Expires.IsZero() {
+		t.Errorf("put returned %+v", meta)
+	}
+
+	body, size, err := client.get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(body)
+	body.Close()
+	if string(b) != data || size != int64(len(data)) {
+		t.Errorf("have %q (%d bytes) want %q", b, size, data)
+	}
+
+	if _, err := client.put("other", strings.NewReader("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.list(ListOpts{Prefix: "notes/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Key != key {
+		t.Errorf("list returned %+v", res.Entries)
+	}
+
+	// The commands themselves, against the same node.
+	out := new(bytes.Buffer)
+	c := &cli{socketPath: socket, stdout: out, stderr: io.Discard}
+	if err := runLs(c, []string{"--prefix", "notes/"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), key) || strings.Contains(out.String(), "other") {
+		t.Errorf("ls printed %q", out.String())
+	}
+
+	dst := filepath.Join(t.TempDir(), "out.txt")
+	if err := runGet(c, []string{key, "-o", dst}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != data {
+		t.Errorf("get wrote %q want %q", b, data)
+	}
+	if err := runGet(c, []string{}); !errors.Is(err, errUsage) {
+		t.Errorf("get without a key: have %v want %v", err, errUsage)
+	}
+
+	if err := client.remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.stat(key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat after rm: have %v want %v", err, os.ErrNotExist)
+	}
+	if err := client.remove(key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rm twice: have %v want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestControlHTTP(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:   NewMemoryStore(),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+
+	if err := NewControl(ControlOpts{HTTPAddr: "0.0.0.0:0", Server: s}).ListenAndServe(); err == nil {
+		t.Error("control API served on a non-loopback address")
+	}
+
+	control := NewControl(ControlOpts{
+		SocketPath: filepath.Join(t.TempDir(), "rvt.sock"),
+		HTTPAddr:   "127.0.0.1:0",
+		Server:     s,
+	})
+	go control.ListenAndServe()
+	defer control.Close()
+
+	for i := 0; i < 50 && control.Addr() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if control.Addr() == nil {
+		t.Fatal("control API never started listening")
+	}
+	base := "http://" + control.Addr().String()
+
+	// Sent chunked, the way a client streaming a body of unknown size does.
+	data := strings.Repeat("stream me ", 10000)
+	req, _ := http.NewRequest(http.MethodPut, base+"/objects/big", io.MultiReader(strings.NewReader(data)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("put: have status %d want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	resp, err = http.Get(base + "/objects/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != data {
+		t.Errorf("get returned %d bytes want %d", len(b), len(data))
+	}
+
+	var status Status
+	resp, err = http.Get(base + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.ID != s.ID || len(status.Peers) != 0 {
+		t.Errorf("status returned %+v", status)
+	}
+
+	// A browser sent here by a name pointing at 127.0.0.1 is turned away.
+	req, _ = http.NewRequest(http.MethodGet, base+"/peers", nil)
+	req.Host = "attacker.example:80"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("foreign host: have status %d want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestControlSocketDir(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:   NewMemoryStore(),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+	runtime := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+
+	control := NewControl(ControlOpts{Server: s})
+	go control.ListenAndServe()
+	defer control.Close()
+
+	socket := filepath.Join(runtime, "rvt", defaultSocketName)
+	if control.SocketPath != socket {
+		t.Fatalf("socket at %s want %s", control.SocketPath, socket)
+	}
+	client := newControlClient(socket)
+	waitFor(t, "the control socket", func() bool {
+		_, err := client.list(ListOpts{})
+		return err == nil
+	})
+
+	if fi, err := os.Stat(filepath.Dir(socket)); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("socket directory: %v, %v", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket: %v, %v", fi.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(socket)); len(entries) != 1 {
+		t.Errorf("socket directory holds %d entries want 1", len(entries))
+	}
+
+	// A default socket directory others can get into is neither listened on
+	// nor trusted.
+	if err := os.Chmod(filepath.Dir(socket), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newControlClient(socket).list(ListOpts{}); err == nil {
+		t.Error("client trusted a socket directory open to others")
+	}
+	other := NewControl(ControlOpts{Server: s})
+	if err := other.ListenAndServe(); err == nil {
+		t.Error("control API listening in a directory open to others")
+	}
+}
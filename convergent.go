@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// convergentID is the owner ID convergent blobs are stored under on every
+// node. Blobs don't belong to anyone: the same plaintext stored by different
+// owners maps to the same blob, which is what lets it be kept only once.
+const convergentID = "convergent"
+
+// maxConvergentRefSize bounds how much we read when decoding a reference.
+const maxConvergentRefSize = 4096
+
+// convergentRefMagic starts every reference, telling it apart from a regular
+// object once decrypted.
+var convergentRefMagic = []byte("rivulet convergent ref\n")
+
+// convergentRef is what an owner stores under its own key in convergent mode,
+// encrypted like any other object. It points at the shared blob and carries
+// the content key needed to decrypt it.
+type convergentRef struct {
+	Blob string
+	Key  []byte
+}
+
+// blobKey is the key a convergent blob is stored under: the hash of its
+// ciphertext, so peers can't be made to store the wrong bytes under it
+// without it showing.
+func blobKey(blob []byte) string {
+	hash := sha256.Sum256(blob)
+	return hex.EncodeToString(hash[:])
+}
+
+func writeConvergentRef(w io.Writer, ref convergentRef) error {
+	if _, err := w.Write(convergentRefMagic); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(ref)
+}
+
+// isConvergentRef reports whether what br holds is a convergent reference,
+// without consuming anything.
+func isConvergentRef(br *bufio.Reader) bool {
+	head, _ := br.Peek(len(convergentRefMagic))
+	return bytes.Equal(head, convergentRefMagic)
+}
+
+func readConvergentRef(r io.Reader) (*convergentRef, error) {
+	if _, err := io.ReadFull(r, make([]byte, len(convergentRefMagic))); err != nil {
+		return nil, err
+	}
+
+	var ref convergentRef
+	if err := json.NewDecoder(io.LimitReader(r, maxConvergentRefSize)).Decode(&ref); err != nil {
+		return nil, err
+	}
+	if ref.Blob == "" || len(ref.Key) == 0 {
+		return nil, errors.New("invalid convergent reference")
+	}
+	return &ref, nil
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/md5"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 )
 
 func generateID() string {
@@ -15,9 +22,42 @@ func generateID() string {
 	return hex.EncodeToString(buf)
 }
 
-func hashKey(key string) string {
-	hash := md5.Sum([]byte(key))
-	return hex.EncodeToString(hash[:])
+// hashKey is the name key goes by on the wire and on the peers holding our
+// replicas: a keyed HMAC-SHA-256, so only whoever holds nameKey can tell which
+// name it stands for.
+func hashKey(nameKey []byte, key string) string {
+	mac := hmac.New(sha256.New, nameKey)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// objectKey derives the key the object named name is sealed with from one of
+// the keys of the keystore. Handing it out gives access to that one object and
+// nothing else.
+func objectKey(key []byte, name string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("rivulet object key:"))
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// sealName encrypts a key name so that only its owner can read it back. It
+// travels with the replicas so the owner can recover the names behind the
+// hashed keys its peers hold.
+func sealName(key []byte, name string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, strings.NewReader(name), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func openName(keys keyLookup, sealed []byte) (string, error) {
+	buf := new(strings.Builder)
+	if _, err := copyDecryptWith(keys, bytes.NewReader(sealed), buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
 }
 
 func newEncryptionKey() []byte {
@@ -26,64 +66,276 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
+// Encrypted objects are written as a header followed by a sequence of chunks,
+// each sealed on its own with AES-GCM:
+//
+//	header: magic "rvt" | version (1) | key ID (8) | chunk size (4) | nonce prefix (7)
+//	chunk:  ciphertext of up to chunk size bytes | GCM tag (16)
+//
+// The key ID tells which key of the keystore sealed the object. Version 1
+// headers predate it and carry no key ID.
+//
+// The nonce of a chunk is the nonce prefix followed by the chunk index and a
+// flag set only on the last chunk, and the header is bound to every chunk as
+// additional data. Reordering or dropping chunks breaks the nonce, cutting the
+// stream short leaves it without a final chunk, and any flipped bit fails the
+// tag, so all of them are caught when decrypting.
+const (
+	cryptoVersion     = 2
+	cryptoChunkSize   = 64 * 1024
+	cryptoKeyIDSize   = 8
+	cryptoNoncePrefix = 7
+	cryptoHeaderSize  = 3 + 1 + cryptoKeyIDSize + 4 + cryptoNoncePrefix
+	cryptoTagSize     = 16
+
+	cryptoHeaderSizeV1 = 3 + 1 + 4 + cryptoNoncePrefix
+)
+
+var cryptoMagic = []byte("rvt")
+
+var (
+	errCorruptCiphertext = errors.New("encrypted stream is corrupt or has been tampered with")
+	errTruncatedStream   = errors.New("encrypted stream is truncated")
+	errUnknownKey        = errors.New("encrypted stream was sealed with an unknown key")
+)
+
+// keyLookup returns the key with the given ID. Streams in the version 1
+// format ask for the empty ID.
+type keyLookup func(id string) ([]byte, error)
+
+// keyID derives the public identifier of an encryption key. It is a hash of
+// the key, so it can be recomputed from the key alone and tells nothing about
+// it.
+func keyID(key []byte) string {
+	hash := sha256.Sum256(append([]byte("rivulet key id:"), key...))
+	return hex.EncodeToString(hash[:cryptoKeyIDSize])
+}
+
+// encryptedSize returns the size of the stream copyEncrypt produces for n
+// bytes of plaintext.
+func encryptedSize(n int64) int64 {
+	// An empty stream still gets one (empty) final chunk.
+	chunks := (n + cryptoChunkSize - 1) / cryptoChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return cryptoHeaderSize + n + chunks*cryptoTagSize
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 0, cryptoNoncePrefix+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// atEOF reports whether br has nothing left to read.
+func atEOF(br *bufio.Reader) (bool, error) {
+	_, err := br.Peek(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// copyEncrypt reads src until EOF and writes it to dst in the encrypted
+// format. It returns the number of bytes written to dst.
+func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	noncePrefix := make([]byte, cryptoNoncePrefix)
+	if _, err := io.ReadFull(rand.Reader, noncePrefix); err != nil {
+		return 0, err
+	}
+	return sealStream(key, noncePrefix, src, dst)
+}
+
+// copyEncryptConvergent works like copyEncrypt but derives the nonce prefix
+// from the key, so the same key and plaintext always give the same bytes.
+// This is only safe with keys derived from the plaintext (see convergentKey):
+// a repeated nonce then always comes with the exact same plaintext.
+func copyEncryptConvergent(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	hash := sha256.Sum256(append([]byte("rivulet convergent nonce:"), key...))
+	return sealStream(key, hash[:cryptoNoncePrefix], src, dst)
+}
+
+// convergentKey derives the content key of plaintext for convergent
+// encryption.
+func convergentKey(plaintext []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("rivulet convergent key:"))
+	h.Write(plaintext)
+	return h.Sum(nil)
+}
+
+func sealStream(key []byte, noncePrefix []byte, src io.Reader, dst io.Writer) (int, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, cryptoHeaderSize)
+	copy(header, cryptoMagic)
+	header[3] = cryptoVersion
+	id, _ := hex.DecodeString(keyID(key))
+	copy(header[4:], id)
+	binary.BigEndian.PutUint32(header[12:16], cryptoChunkSize)
+	copy(header[16:], noncePrefix)
+	noncePrefix = header[16:]
+
+	nw, err := dst.Write(header)
+	if err != nil {
+		return nw, err
+	}
+
 	var (
-		buf = make([]byte, 32*1024)
-		nw  = blockSize
+		br  = bufio.NewReader(src)
+		buf = make([]byte, cryptoChunkSize, cryptoChunkSize+cryptoTagSize)
 	)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			nn, err := dst.Write(buf[:n])
-			if err != nil {
-				return 0, err
-			}
-			nw += nn
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return nw, err
 		}
-		if err == io.EOF {
-			break
+		if !final {
+			if final, err = atEOF(br); err != nil {
+				return nw, err
+			}
 		}
+
+		sealed := aead.Seal(buf[:0], chunkNonce(noncePrefix, index, final), buf[:n], header)
+		nn, err := dst.Write(sealed)
+		nw += nn
 		if err != nil {
-			return 0, err
+			return nw, err
+		}
+
+		if final {
+			return nw, nil
+		}
+		if index == ^uint32(0) {
+			return nw, errors.New("stream too large to encrypt")
 		}
 	}
-	return nw, nil
 }
 
+// copyDecrypt reads an encrypted stream from src and writes the plaintext to
+// dst, checking every chunk before it is written. It returns the number of
+// plaintext bytes written to dst.
 func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
+	id := keyID(key)
+	return copyDecryptWith(func(want string) ([]byte, error) {
+		if want != "" && want != id {
+			return nil, errUnknownKey
+		}
+		return key, nil
+	}, src, dst)
+}
+
+// copyDecryptWith works like copyDecrypt, picking the key named in the header
+// of the stream through keys.
+func copyDecryptWith(keys keyLookup, src io.Reader, dst io.Writer) (int, error) {
+	header := make([]byte, cryptoHeaderSize)
+	if _, err := io.ReadFull(src, header[:4]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, errTruncatedStream
+		}
 		return 0, err
 	}
+	if !bytes.Equal(header[:3], cryptoMagic) {
+		return 0, errCorruptCiphertext
+	}
 
-	// Read the IV from the given io.Reader which, in our case should be the
-	// the block.BlockSize() bytes we read.
-	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	switch header[3] {
+	case 1:
+		header = header[:cryptoHeaderSizeV1]
+	case cryptoVersion:
+	default:
+		return 0, fmt.Errorf("unsupported encryption format version %d", header[3])
+	}
+
+	if _, err := io.ReadFull(src, header[4:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, errTruncatedStream
+		}
 		return 0, err
 	}
+	var id string
+	if header[3] == cryptoVersion {
+		id = hex.EncodeToString(header[4 : 4+cryptoKeyIDSize])
+	}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
-}
+	var (
+		chunkSize   = binary.BigEndian.Uint32(header[len(header)-cryptoNoncePrefix-4:])
+		noncePrefix = header[len(header)-cryptoNoncePrefix:]
+	)
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		return 0, errCorruptCiphertext
+	}
 
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+	key, err := keys(id)
 	if err != nil {
 		return 0, err
 	}
-
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	aead, err := newGCM(key)
+	if err != nil {
 		return 0, err
 	}
 
-	// prepend the IV to the file.
-	if _, err := dst.Write(iv); err != nil {
-		return 0, err
-	}
+	var (
+		br       = bufio.NewReader(src)
+		buf      = make([]byte, int(chunkSize)+cryptoTagSize)
+		plainBuf = make([]byte, 0, chunkSize)
+		nw       int
+	)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err == io.EOF {
+			// Every stream ends with a chunk flagged as final, so running
+			// out of chunks before it means bytes were cut off.
+			return nw, errTruncatedStream
+		}
+		final := err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return nw, err
+		}
+		if !final {
+			if final, err = atEOF(br); err != nil {
+				return nw, err
+			}
+		}
+
+		plain, err := aead.Open(plainBuf[:0], chunkNonce(noncePrefix, index, final), buf[:n], header)
+		if err != nil {
+			if !final {
+				return nw, errCorruptCiphertext
+			}
+			// A stream cut exactly on a chunk boundary leaves us with a
+			// non final chunk at the end.
+			if _, err := aead.Open(nil, chunkNonce(noncePrefix, index, false), buf[:n], header); err == nil {
+				return nw, errTruncatedStream
+			}
+			return nw, errCorruptCiphertext
+		}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+		nn, err := dst.Write(plain)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if final {
+			return nw, nil
+		}
+	}
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"fmt"
 	"testing"
 )
 
@@ -11,13 +10,14 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	src := bytes.NewReader([]byte(payload))
 	dst := new(bytes.Buffer)
 	key := newEncryptionKey()
-	_, err := copyEncrypt(key, src, dst)
+	n, err := copyEncrypt(key, src, dst)
 	if err != nil {
 		t.Error(err)
 	}
 
-	fmt.Println(len(payload))
-	fmt.Println(len(dst.String()))
+	if int64(n) != encryptedSize(int64(len(payload))) || n != dst.Len() {
+		t.Errorf("have %d encrypted bytes, want %d", n, encryptedSize(int64(len(payload))))
+	}
 
 	out := new(bytes.Buffer)
 	nw, err := copyDecrypt(key, dst, out)
@@ -25,7 +25,7 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Error(err)
 	}
 
-	if nw != 16+len(payload) {
+	if nw != len(payload) {
 		t.Fail()
 	}
 
@@ -33,3 +33,125 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Errorf("decryption failed!!!")
 	}
 }
+
+func TestCopyEncryptDecryptChunks(t *testing.T) {
+	key := newEncryptionKey()
+
+	for _, size := range []int{0, 1, cryptoChunkSize - 1, cryptoChunkSize, cryptoChunkSize + 1, 3*cryptoChunkSize + 17} {
+		payload := bytes.Repeat([]byte{0xab}, size)
+
+		enc := new(bytes.Buffer)
+		if _, err := copyEncrypt(key, bytes.NewReader(payload), enc); err != nil {
+			t.Fatal(err)
+		}
+		if int64(enc.Len()) != encryptedSize(int64(size)) {
+			t.Errorf("size %d: have %d encrypted bytes want %d", size, enc.Len(), encryptedSize(int64(size)))
+		}
+
+		out := new(bytes.Buffer)
+		if _, err := copyDecrypt(key, enc, out); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("size %d: decryption failed", size)
+		}
+	}
+}
+
+func TestCopyDecryptDetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	payload := bytes.Repeat([]byte("rivulet "), cryptoChunkSize/3)
+
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+	sealed := enc.Bytes()
+	chunk := cryptoChunkSize + cryptoTagSize
+
+	flipped := bytes.Clone(sealed)
+	flipped[cryptoHeaderSize+10] ^= 0x01
+
+	reordered := bytes.Clone(sealed[:cryptoHeaderSize])
+	reordered = append(reordered, sealed[cryptoHeaderSize+chunk:cryptoHeaderSize+2*chunk]...)
+	reordered = append(reordered, sealed[cryptoHeaderSize:cryptoHeaderSize+chunk]...)
+	reordered = append(reordered, sealed[cryptoHeaderSize+2*chunk:]...)
+
+	cases := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"flipped bit":          {flipped, errCorruptCiphertext},
+		"reordered chunks":     {reordered, errCorruptCiphertext},
+		"truncated on chunk":   {sealed[:cryptoHeaderSize+chunk], errTruncatedStream},
+		"truncated mid chunk":  {sealed[:len(sealed)-5], errCorruptCiphertext},
+		"truncated header":     {sealed[:4], errTruncatedStream},
+		"wrong key":            {sealed, errUnknownKey},
+		"dropped final chunks": {sealed[:cryptoHeaderSize+2*chunk], errTruncatedStream},
+	}
+
+	for name, tc := range cases {
+		k := key
+		if name == "wrong key" {
+			k = newEncryptionKey()
+		}
+		_, err := copyDecrypt(k, bytes.NewReader(tc.data), new(bytes.Buffer))
+		if err != tc.err {
+			t.Errorf("%s: have %v want %v", name, err, tc.err)
+		}
+	}
+}
+
+func TestCopyEncryptConvergent(t *testing.T) {
+	encrypt := func(plaintext []byte) []byte {
+		dst := new(bytes.Buffer)
+		if _, err := copyEncryptConvergent(convergentKey(plaintext), bytes.NewReader(plaintext), dst); err != nil {
+			t.Fatal(err)
+		}
+		return dst.Bytes()
+	}
+
+	a := encrypt([]byte("Foo not bar"))
+	b := encrypt([]byte("Foo not bar"))
+	c := encrypt([]byte("Bar not foo"))
+
+	if !bytes.Equal(a, b) {
+		t.Errorf("identical plaintext gave different ciphertext")
+	}
+	if bytes.Equal(a, c) {
+		t.Errorf("different plaintext gave the same ciphertext")
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(convergentKey([]byte("Foo not bar")), bytes.NewReader(a), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Foo not bar" {
+		t.Errorf("decryption failed!!!")
+	}
+}
+
+func TestSealName(t *testing.T) {
+	key := newEncryptionKey()
+	nameKey := newEncryptionKey()
+
+	if hashKey(nameKey, "secret.txt") == hashKey(newEncryptionKey(), "secret.txt") {
+		t.Errorf("hashed name does not depend on the name key")
+	}
+
+	sealed, err := sealName(key, "secret.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret.txt")) {
+		t.Errorf("sealed name leaks the name")
+	}
+
+	name, err := openName(newMemoryKeystore(key).Key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "secret.txt" {
+		t.Errorf("have %s want secret.txt", name)
+	}
+}
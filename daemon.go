@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+const (
+	identityFileName = "node.json"
+	pidFileName      = "rvt.pid"
+
+	// shutdownTimeout is how long the daemon gives transfers in flight to
+	// complete once asked to stop, before cutting them short.
+	shutdownTimeout = 30 * time.Second
+)
+
+// daemonConfig is the config file of rvt daemon, a JSON object. Every field
+// is optional. Durations are strings such as "90s" or "24h".
+type daemonConfig struct {
+	// ID is the owner ID of the node, and NodeID the ID it goes by in the
+	// vector clocks. Both are generated on first start and kept under Root
+	// when left empty.
+	ID     string
+	NodeID string
+
+	Listen    string
+	Root      string
+	Socket    string
+	Bootstrap []string
+	// ControlHTTP is a loopback address to serve the control API on, on top
+	// of the socket. It is not served over TCP when left empty.
+	ControlHTTP string
+	// S3Addr turns on the S3 gateway, serving the objects of the node as the
+	// bucket S3Bucket, "rivulet" when left empty. Requests have to be signed
+	// with S3AccessKey and S3SecretKey if set, which RVT_S3_ACCESS_KEY and
+	// RVT_S3_SECRET_KEY override. Without them the gateway only listens on
+	// loopback addresses.
+	S3Addr      string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Region    string
+	// WebDAVAddr turns on the WebDAV export of the objects of the node.
+	// Clients have to log in with WebDAVUsername and WebDAVPassword if set,
+	// the latter overridden by RVT_WEBDAV_PASSWORD. Without them the export
+	// only listens on loopback addresses.
+	WebDAVAddr     string
+	WebDAVUsername string
+	WebDAVPassword string
+	// MetricsAddr turns on the metrics of the node, served at /metrics in
+	// the Prometheus text format. It only listens on loopback addresses
+	// unless MetricsPublic is set.
+	MetricsAddr   string
+	MetricsPublic bool
+	// TraceFile turns on tracing, the spans of the node being appended to
+	// it as OTLP/JSON, one request per line, for an OpenTelemetry Collector
+	// to pick up.
+	TraceFile string
+
+	// PassphraseFile holds the passphrase of the keystore kept under Root.
+	// RIVULET_PASSPHRASE takes precedence over it. Without either, the node
+	// runs on a throwaway key.
+	PassphraseFile string
+	Convergent     bool
+	DataShards     int
+	ParityShards   int
+	// PackThreshold turns on the packed mode of the store, see StoreOpts.
+	PackThreshold int64
+
+	OwnerQuota  int64
+	OwnerQuotas map[string]int64
+	PeerQuota   int64
+	GlobalQuota int64
+	// OwnerKeys pins the signing keys, base64 encoded, of the owners whose
+	// capabilities the node honours, by owner ID. rvt status shows the key
+	// of a node.
+	OwnerKeys map[string]ed25519.PublicKey
+
+	KeepVersions  int
+	VersionMaxAge configDuration
+	// Resolver is "last-writer-wins", the default, or "keep-siblings".
+	Resolver      string
+	SweepInterval configDuration
+
+	// LogLevel is "debug", "info", the default, "warn" or "error", and
+	// LogFormat "text", the default, or "json". Logs go to stderr.
+	LogLevel  string
+	LogFormat string
+}
+
+// configDuration is a time.Duration written as a string in the config file.
+type configDuration struct {
+	time.Duration
+}
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1h\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// loadDaemonConfig reads the config file at path. An empty path gives the
+// default config.
+func loadDaemonConfig(path string) (daemonConfig, error) {
+	cfg := daemonConfig{Listen: ":3000"}
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides cfg with the RVT_* environment variables that are set.
+func (cfg *daemonConfig) applyEnv() {
+	if v := os.Getenv("RVT_ID"); v != "" {
+		cfg.ID = v
+	}
+	if v := os.Getenv("RVT_LISTEN"); v != "" {
+		cfg.Listen = v
+	}
+	if v := os.Getenv("RVT_ROOT"); v != "" {
+		cfg.Root = v
+	}
+	if v := os.Getenv("RVT_BOOTSTRAP"); v != "" {
+		cfg.Bootstrap = splitList(v)
+	}
+	if v := os.Getenv("RVT_CONTROL_HTTP"); v != "" {
+		cfg.ControlHTTP = v
+	}
+	if v := os.Getenv("RVT_METRICS"); v != "" {
+		cfg.MetricsAddr = v
+	}
+	if v := os.Getenv("RVT_TRACE_FILE"); v != "" {
+		cfg.TraceFile = v
+	}
+	if v := os.Getenv("RVT_S3_ACCESS_KEY"); v != "" {
+		cfg.S3AccessKey = v
+	}
+	if v := os.Getenv("RVT_S3_SECRET_KEY"); v != "" {
+		cfg.S3SecretKey = v
+	}
+	if v := os.Getenv("RVT_WEBDAV_PASSWORD"); v != "" {
+		cfg.WebDAVPassword = v
+	}
+	if v := os.Getenv("RVT_LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+}
+
+// logger returns the logger cfg describes, writing to w.
+func (cfg daemonConfig) logger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if cfg.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return nil, fmt.Errorf("unknown log level %q", cfg.LogLevel)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch cfg.LogFormat {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.LogFormat)
+	}
+}
+
+// tracer returns the tracer of the node along with the file it writes to, or
+// nil for both when tracing is off.
+func (cfg daemonConfig) tracer() (Tracer, *os.File, error) {
+	if cfg.TraceFile == "" {
+		return nil, nil, nil
+	}
+
+	f, err := os.OpenFile(cfg.TraceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	tracer := NewFileTracer(FileTracerOpts{
+		Writer:     f,
+		InstanceID: cfg.NodeID,
+	})
+	return tracer, f, nil
+}
+
+func (cfg daemonConfig) resolver() (ConflictResolver, error) {
+	switch cfg.Resolver {
+	case "", "last-writer-wins":
+		return LastWriterWins, nil
+	case "keep-siblings":
+		return KeepSiblings, nil
+	}
+	return nil, fmt.Errorf("unknown resolver %q", cfg.Resolver)
+}
+
+func (cfg daemonConfig) passphrase() (string, error) {
+	if passphrase := os.Getenv("RIVULET_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	if cfg.PassphraseFile == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(cfg.PassphraseFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// identity is what a node keeps under its root to come back as itself after
+// a restart: the objects it handed out are namespaced under its ID.
+type identity struct {
+	ID     string
+	NodeID string
+}
+
+// loadIdentity fills in the IDs of cfg left empty from those kept under its
+// root, generating and keeping them on first start.
+func (cfg *daemonConfig) loadIdentity() error {
+	path := filepath.Join(cfg.Root, identityFileName)
+
+	var id identity
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &id); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	if id.ID == "" || id.NodeID == "" {
+		if id.ID == "" {
+			id.ID = generateID()
+		}
+		if id.NodeID == "" {
+			id.NodeID = generateID()[:16]
+		}
+		b, err := json.MarshalIndent(id, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ID == "" {
+		cfg.ID = id.ID
+	}
+	if cfg.NodeID == "" {
+		cfg.NodeID = id.NodeID
+	}
+	return nil
+}
+
+// newServer builds the node cfg describes, logging to logger.
+func (cfg daemonConfig) newServer(logger *slog.Logger, tracer Tracer) (*FileServer, error) {
+	resolver, err := cfg.resolver()
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := cfg.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	var keystore *Keystore
+	if passphrase != "" {
+		if keystore, err = OpenKeystore(cfg.Root, passphrase); err != nil {
+			return nil, err
+		}
+	} else {
+		logger.Warn("no passphrase set, running on a throwaway key: objects handed to peers can't be read back after a restart")
+	}
+
+	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    cfg.Listen,
+		Decoder:       p2p.DefaultDecoder{},
+		HandShakeFunc: p2p.DefaultHandSake,
+		Logger:        logger,
+	})
+
+	server := NewFileServer(FileServerOPts{
+		ID:           cfg.ID,
+		NodeID:       cfg.NodeID,
+		StoreageRoot: cfg.Root,
+		Keystore:     keystore,
+		Convergent:   cfg.Convergent,
+		DataShards:   cfg.DataShards,
+		ParityShards: cfg.ParityShards,
+		OwnerQuota:   cfg.OwnerQuota,
+		OwnerQuotas:  cfg.OwnerQuotas,
+		PeerQuota:    cfg.PeerQuota,
+		GlobalQuota:  cfg.GlobalQuota,
+		OwnerKeys:    cfg.OwnerKeys,
+		VersionPolicy: VersionPolicy{
+			Keep:   cfg.KeepVersions,
+			MaxAge: cfg.VersionMaxAge.Duration,
+		},
+		Resolver:      resolver,
+		SweepInterval: cfg.SweepInterval.Duration,
+		Storage: NewStore(StoreOpts{
+			Root:              cfg.Root,
+			PathTransformFunc: CASPathTransformFunc,
+			PackThreshold:     cfg.PackThreshold,
+			Logger:            logger,
+		}),
+		Transport:      tcpTransport,
+		BootstrapNodes: cfg.Bootstrap,
+		Logger:         logger,
+		Tracer:         tracer,
+	})
+
+	tcpTransport.OnPeer = server.onPeer
+
+	return server, nil
+}
+
+// errRootLocked is returned when another daemon already runs on a storage
+// root.
+var errRootLocked = errors.New("storage root is in use by another daemon")
+
+// lockRoot writes our PID file under root and holds a lock on it for as long
+// as the daemon runs, failing if another daemon holds it. The lock goes away
+// with the process, so a PID file left behind by a daemon that did not get to
+// clean up doesn't hold the root. The returned func removes it.
+func lockRoot(root string, logger *slog.Logger) (func(), error) {
+	path := filepath.Join(root, pidFileName)
+
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			b, _ := io.ReadAll(f)
+			f.Close()
+			if !errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, err
+			}
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+				return nil, fmt.Errorf("%w: %s (pid %d)", errRootLocked, root, pid)
+			}
+			return nil, fmt.Errorf("%w: %s", errRootLocked, root)
+		}
+
+		// The daemon we were waiting on may have removed the file between
+		// our open and our lock, leaving us a lock on a file nobody else
+		// will open.
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if cur, err := os.Stat(path); err != nil || !os.SameFile(locked, cur) {
+			f.Close()
+			continue
+		}
+
+		if locked.Size() > 0 {
+			logger.Warn("taking over stale pid file", "path", path)
+		}
+		if err := writePID(f); err != nil {
+			os.Remove(path)
+			f.Close()
+			return nil, err
+		}
+
+		return func() {
+			os.Remove(path)
+			f.Close()
+		}, nil
+	}
+}
+
+// writePID replaces what f holds with our PID.
+func writePID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// runDaemon runs a node along with its control API until it is told to stop
+// with SIGINT or SIGTERM.
+func runDaemon(c *cli, args []string) error {
+	fs := c.commandFlags("daemon", "[--config file] [--listen addr] [--root dir] [--bootstrap addr,...] [--id id] [--http addr] [--s3 addr] [--webdav addr] [--metrics addr] [--trace-file file] [--log-level level]")
+	configPath := fs.String("config", os.Getenv("RVT_CONFIG"), "config file (default $RVT_CONFIG)")
+	listen := fs.String("listen", "", "address to listen for peers on (default :3000)")
+	root := fs.String("root", "", "directory to keep objects in (default <listen>_network)")
+	bootstrap := fs.String("bootstrap", "", "comma separated peers to connect to on start")
+	id := fs.String("id", "", "owner ID of the node (default generated once and kept under the root)")
+	controlHTTP := fs.String("http", "", "loopback address to serve the control API on as well, such as 127.0.0.1:3080")
+	s3Addr := fs.String("s3", "", "address to serve the S3 gateway on, such as 127.0.0.1:9000")
+	webdavAddr := fs.String("webdav", "", "address to serve the WebDAV export on, such as 127.0.0.1:8080")
+	metricsAddr := fs.String("metrics", "", "address to serve Prometheus metrics on, such as 127.0.0.1:9100")
+	traceFile := fs.String("trace-file", "", "file to append OTLP/JSON trace spans to")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error (default info)")
+
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	// The config file comes first, then the environment, then the flags.
+	cfg, err := loadDaemonConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	cfg.applyEnv()
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "root":
+			cfg.Root = *root
+		case "bootstrap":
+			cfg.Bootstrap = splitList(*bootstrap)
+		case "id":
+			cfg.ID = *id
+		case "http":
+			cfg.ControlHTTP = *controlHTTP
+		case "s3":
+			cfg.S3Addr = *s3Addr
+		case "webdav":
+			cfg.WebDAVAddr = *webdavAddr
+		case "metrics":
+			cfg.MetricsAddr = *metricsAddr
+		case "trace-file":
+			cfg.TraceFile = *traceFile
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		}
+	})
+	if c.socketPath != "" {
+		cfg.Socket = c.socketPath
+	}
+	if cfg.Root == "" {
+		cfg.Root = cfg.Listen + "_network"
+	}
+
+	if err := os.MkdirAll(cfg.Root, 0700); err != nil {
+		return err
+	}
+	logger, err := cfg.logger(c.stderr)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockRoot(cfg.Root, logger)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := cfg.loadIdentity(); err != nil {
+		return err
+	}
+
+	tracer, traceOut, err := cfg.tracer()
+	if err != nil {
+		return err
+	}
+	if traceOut != nil {
+		defer traceOut.Close()
+		logger.Info("writing traces", "file", cfg.TraceFile)
+	}
+
+	server, err := cfg.newServer(logger, tracer)
+	if err != nil {
+		return err
+	}
+
+	control := NewControl(ControlOpts{
+		SocketPath: cfg.Socket,
+		HTTPAddr:   cfg.ControlHTTP,
+		Server:     server,
+	})
+	defer control.Close()
+
+	// The control API, the gateway, the WebDAV export and the metrics,
+	// whichever fails first.
+	frontErr := make(chan error, 4)
+	go func() {
+		frontErr <- control.ListenAndServe()
+	}()
+
+	var gateway *Gateway
+	if cfg.S3Addr != "" {
+		bucket := cfg.S3Bucket
+		if bucket == "" {
+			bucket = "rivulet"
+		}
+		gateway = NewGateway(GatewayOpts{
+			ListenAddr: cfg.S3Addr,
+			Buckets:    map[string]*FileServer{bucket: server},
+			AccessKey:  cfg.S3AccessKey,
+			SecretKey:  cfg.S3SecretKey,
+			Region:     cfg.S3Region,
+			UploadDir:  filepath.Join(cfg.Root, "uploads"),
+			Logger:     logger,
+		})
+		defer gateway.Close()
+
+		go func() {
+			frontErr <- gateway.ListenAndServe()
+		}()
+		logger.Info("serving S3 gateway", "bucket", bucket, "addr", cfg.S3Addr)
+	}
+
+	var dav *WebDAV
+	if cfg.WebDAVAddr != "" {
+		dav = NewWebDAV(WebDAVOpts{
+			ListenAddr: cfg.WebDAVAddr,
+			Server:     server,
+			Username:   cfg.WebDAVUsername,
+			Password:   cfg.WebDAVPassword,
+			Logger:     logger,
+		})
+		defer dav.Close()
+
+		go func() {
+			frontErr <- dav.ListenAndServe()
+		}()
+		logger.Info("serving WebDAV export", "addr", cfg.WebDAVAddr)
+	}
+
+	var metrics *Metrics
+	if cfg.MetricsAddr != "" {
+		metrics = NewMetrics(MetricsOpts{
+			ListenAddr: cfg.MetricsAddr,
+			Public:     cfg.MetricsPublic,
+			Server:     server,
+		})
+		defer metrics.Close()
+
+		go func() {
+			frontErr <- metrics.ListenAndServe()
+		}()
+		logger.Info("serving metrics", "addr", cfg.MetricsAddr)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Start()
+	}()
+
+	logger.Info("node started", "id", cfg.ID, "node", cfg.Listen, "root", cfg.Root, "socket", control.SocketPath)
+	if cfg.ControlHTTP != "" {
+		logger.Info("serving control API over HTTP", "addr", cfg.ControlHTTP)
+	}
+
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case err := <-serverErr:
+		return err
+	case err := <-frontErr:
+		server.Stop()
+		<-serverErr
+		return err
+	case sig := <-sigc:
+		logger.Info("shutting down", "signal", sig.String())
+	}
+
+	control.Close()
+	if gateway != nil {
+		gateway.Close()
+	}
+	if dav != nil {
+		dav.Close()
+	}
+	if metrics != nil {
+		metrics.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.StopContext(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			return err
+		}
+		return <-serverErr
+	case sig := <-sigc:
+		// Cut what is in flight short, without waiting for it.
+		cancel()
+		return fmt.Errorf("received %s again, not waiting for the node to stop", sig)
+	}
+}
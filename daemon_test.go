@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDaemonConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rvt.json")
+	config := `{
+		"Listen": ":4000",
+		"Bootstrap": [":3000"],
+		"KeepVersions": 3,
+		"VersionMaxAge": "24h",
+		"Resolver": "keep-siblings",
+		"OwnerKeys": {"alice": "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("RVT_LISTEN", ":5000")
+	cfg, err := loadDaemonConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.applyEnv()
+
+	if cfg.Listen != ":5000" {
+		t.Errorf("listen: have %s want :5000 from the environment", cfg.Listen)
+	}
+	if len(cfg.Bootstrap) != 1 || cfg.Bootstrap[0] != ":3000" {
+		t.Errorf("bootstrap: have %v", cfg.Bootstrap)
+	}
+	if cfg.VersionMaxAge.Duration != 24*time.Hour {
+		t.Errorf("version max age: have %s want 24h", cfg.VersionMaxAge)
+	}
+	if _, err := cfg.resolver(); err != nil {
+		t.Error(err)
+	}
+	if key := cfg.OwnerKeys["alice"]; len(key) != ed25519.PublicKeySize {
+		t.Errorf("owner key: have %x", key)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"Listn": ":4000"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDaemonConfig(path); err == nil {
+		t.Error("config with an unknown field loaded fine")
+	}
+}
+
+func TestDaemonLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger, err := daemonConfig{LogLevel: "warn", LogFormat: "json"}.logger(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("left out")
+	logger.Warn("kept", "key", "notes.txt", "bytes", 42)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, buf)
+	}
+	if record["msg"] != "kept" || record["key"] != "notes.txt" || record["bytes"] != 42.0 {
+		t.Errorf("logged %s", buf)
+	}
+
+	if _, err := (daemonConfig{LogLevel: "loud"}).logger(buf); err == nil {
+		t.Error("unknown log level accepted")
+	}
+	if _, err := (daemonConfig{LogFormat: "xml"}).logger(buf); err == nil {
+		t.Error("unknown log format accepted")
+	}
+}
+
+func TestIdentityPersists(t *testing.T) {
+	root := t.TempDir()
+
+	first := daemonConfig{Root: root}
+	if err := first.loadIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	second := daemonConfig{Root: root}
+	if err := second.loadIdentity(); err != nil {
+		t.Fatal(err)
+	}
+
+	if first.ID == "" || first.ID != second.ID || first.NodeID != second.NodeID {
+		t.Errorf("identity changed across starts: %s/%s then %s/%s", first.ID, first.NodeID, second.ID, second.NodeID)
+	}
+}
+
+func TestLockRoot(t *testing.T) {
+	root := t.TempDir()
+
+	unlock, err := lockRoot(root, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockRoot(root, discardLogger()); !errors.Is(err, errRootLocked) {
+		t.Errorf("second lock: have %v want %v", err, errRootLocked)
+	}
+	unlock()
+
+	// A PID file left behind by a daemon that is gone doesn't hold the root.
+	path := filepath.Join(root, pidFileName)
+	if err := os.WriteFile(path, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = lockRoot(root, discardLogger())
+	if err != nil {
+		t.Fatalf("stale pid file: %s", err)
+	}
+	unlock()
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("pid file left behind after unlock: %v", err)
+	}
+
+	// Nor does one naming a process that is alive but never locked it, such
+	// as one that got the PID of a daemon that is gone.
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = lockRoot(root, discardLogger())
+	if err != nil {
+		t.Fatalf("pid file of another process: %s", err)
+	}
+	if b, _ := os.ReadFile(path); strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("pid file holds %q want our pid", b)
+	}
+	unlock()
+}
+
+func TestLockRootRace(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, pidFileName), []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Daemons racing past a stale PID file: exactly one of them gets the
+	// root.
+	const daemons = 8
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		unlocks []func()
+	)
+	for i := 0; i < daemons; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockRoot(root, discardLogger())
+			if err != nil {
+				if !errors.Is(err, errRootLocked) {
+					t.Errorf("have %v want %v", err, errRootLocked)
+				}
+				return
+			}
+			mu.Lock()
+			unlocks = append(unlocks, unlock)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(unlocks) != 1 {
+		t.Errorf("%d daemons got the root want 1", len(unlocks))
+	}
+	for _, unlock := range unlocks {
+		unlock()
+	}
+}
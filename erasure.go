@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+// Erasure coding splits an object into k data shards and adds m parity
+// shards computed with a Reed-Solomon code over GF(2^8), so that any k of the
+// k+m shards are enough to get the object back. Each peer only holds a shard
+// instead of a full copy.
+//
+// The code is systematic: the data shards are the object itself, cut in k, and
+// only the parity shards need computing. The encoding matrix is a Vandermonde
+// matrix turned systematic by multiplying it with the inverse of its top k
+// rows, which keeps every k rows of it invertible.
+
+// gfPoly is the primitive polynomial x^8 + x^4 + x^3 + x^2 + 1 the field is
+// built on.
+const gfPoly = 0x11d
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	// gfMulTable[a][b] is a*b, which is most of the work when coding.
+	gfMulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	return gfMulTable[a][b]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfPow returns a^n.
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) mul(o gfMatrix) gfMatrix {
+	out := newGFMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range o[0] {
+			var v byte
+			for i := range o {
+				v ^= gfMul(m[r][i], o[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+var errSingularMatrix = errors.New("erasure: matrix is singular")
+
+// invert returns the inverse of the square matrix m, by Gauss-Jordan
+// elimination.
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newGFMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errSingularMatrix
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		if inv := gfInv(work[c][c]); inv != 1 {
+			for i := range work[c] {
+				work[c][i] = gfMul(work[c][i], inv)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			f := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul(f, work[c][i])
+			}
+		}
+	}
+
+	out := newGFMatrix(n, n)
+	for r := range out {
+		copy(out[r], work[r][n:])
+	}
+	return out, nil
+}
+
+// reedSolomon codes objects into dataShards+parityShards shards.
+type reedSolomon struct {
+	dataShards   int
+	parityShards int
+	// matrix has a row per shard, the top ones being the identity.
+	matrix gfMatrix
+}
+
+// maxShards is the most shards an object can be cut in: GF(2^8) has no more
+// points to evaluate the code at.
+const maxShards = 256
+
+func newReedSolomon(dataShards, parityShards int) (*reedSolomon, error) {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > maxShards {
+		return nil, fmt.Errorf("erasure: can't code %d data and %d parity shards", dataShards, parityShards)
+	}
+
+	total := dataShards + parityShards
+	vandermonde := newGFMatrix(total, dataShards)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	topInv, err := vandermonde[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reedSolomon{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       vandermonde.mul(topInv),
+	}, nil
+}
+
+func (rs *reedSolomon) shards() int {
+	return rs.dataShards + rs.parityShards
+}
+
+// split cuts data into the data shards, padded with zeroes to the same size,
+// and computes the parity shards.
+func (rs *reedSolomon) split(data []byte) [][]byte {
+	size := (len(data) + rs.dataShards - 1) / rs.dataShards
+
+	shards := make([][]byte, rs.shards())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+	for i := 0; i < rs.dataShards; i++ {
+		if lo := i * size; lo < len(data) {
+			copy(shards[i], data[lo:])
+		}
+	}
+
+	rs.encodeParity(shards)
+	return shards
+}
+
+func (rs *reedSolomon) encodeParity(shards [][]byte) {
+	for p := rs.dataShards; p < rs.shards(); p++ {
+		rs.codeShard(rs.matrix[p], shards[:rs.dataShards], shards[p])
+	}
+}
+
+// codeShard sets out to the combination of the shards in, weighted by coeffs.
+func (rs *reedSolomon) codeShard(coeffs []byte, in [][]byte, out []byte) {
+	clear(out)
+	for i, c := range coeffs {
+		if c == 0 {
+			continue
+		}
+		table := &gfMulTable[c]
+		for b, v := range in[i] {
+			out[b] ^= table[v]
+		}
+	}
+}
+
+var errTooFewShards = errors.New("erasure: too few shards left to reconstruct")
+
+// errNoPeers is returned when there is nobody to hand shards out to.
+var errNoPeers = errors.New("erasure: no peers to hold the shards")
+
+// reconstruct fills in the missing (nil) shards, which takes at least
+// dataShards of them to be present.
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	if len(shards) != rs.shards() {
+		return fmt.Errorf("erasure: have %d shards want %d", len(shards), rs.shards())
+	}
+
+	var (
+		present = make([]int, 0, rs.dataShards)
+		size    = -1
+	)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return fmt.Errorf("erasure: shards are of different sizes")
+		}
+		size = len(shard)
+		if len(present) < rs.dataShards {
+			present = append(present, i)
+		}
+	}
+	if len(present) < rs.dataShards {
+		return errTooFewShards
+	}
+
+	sub := newGFMatrix(rs.dataShards, rs.dataShards)
+	in := make([][]byte, rs.dataShards)
+	for r, i := range present {
+		copy(sub[r], rs.matrix[i])
+		in[r] = shards[i]
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	for d := 0; d < rs.dataShards; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		shards[d] = make([]byte, size)
+		rs.codeShard(decode[d], in, shards[d])
+	}
+	for p := rs.dataShards; p < rs.shards(); p++ {
+		if shards[p] != nil {
+			continue
+		}
+		shards[p] = make([]byte, size)
+		rs.codeShard(rs.matrix[p], shards[:rs.dataShards], shards[p])
+	}
+
+	return nil
+}
+
+// join puts the data shards back together into the size bytes they were cut
+// from.
+func (rs *reedSolomon) join(shards [][]byte, size int64) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:rs.dataShards] {
+		data = append(data, shard...)
+	}
+	if int64(len(data)) < size {
+		return nil, fmt.Errorf("erasure: shards hold %d bytes want %d", len(data), size)
+	}
+	return data[:size], nil
+}
+
+// Every shard handed to a peer carries a header telling where it belongs:
+//
+//	magic "rvs" | version (1) | data shards (1) | parity shards (1) | index (1) | object size (8) | SHA-256 of the shard (32)
+//
+// The data shard count is stored minus one, so that all 256 fit in a byte. The hash
+// catches shards that rotted on a peer, which would otherwise only show as
+// the whole object failing to decrypt, with no telling which shard is to
+// blame.
+const (
+	shardVersion    = 1
+	shardHeaderSize = 3 + 1 + 1 + 1 + 1 + 8 + sha256.Size
+)
+
+var shardMagic = []byte("rvs")
+
+var errCorruptShard = errors.New("erasure: shard is corrupt")
+
+type shardHeader struct {
+	DataShards   int
+	ParityShards int
+	Index        int
+	Size         int64
+}
+
+// shardKey is the key shard i of the object key is stored under.
+func shardKey(key string, i int) string {
+	return fmt.Sprintf("%s.shard%d", key, i)
+}
+
+func writeShard(w io.Writer, h shardHeader, shard []byte) error {
+	hash := sha256.Sum256(shard)
+
+	header := make([]byte, 0, shardHeaderSize)
+	header = append(header, shardMagic...)
+	header = append(header, shardVersion, byte(h.DataShards-1), byte(h.ParityShards), byte(h.Index))
+	header = binary.LittleEndian.AppendUint64(header, uint64(h.Size))
+	header = append(header, hash[:]...)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(shard)
+	return err
+}
+
+func readShard(r io.Reader) (shardHeader, []byte, error) {
+	var h shardHeader
+
+	header := make([]byte, shardHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return h, nil, errCorruptShard
+	}
+	if !bytes.Equal(header[:3], shardMagic) || header[3] != shardVersion {
+		return h, nil, errCorruptShard
+	}
+
+	h.DataShards = int(header[4]) + 1
+	h.ParityShards = int(header[5])
+	h.Index = int(header[6])
+	h.Size = int64(binary.LittleEndian.Uint64(header[7:15]))
+
+	shard, err := io.ReadAll(r)
+	if err != nil {
+		return h, nil, err
+	}
+	if hash := sha256.Sum256(shard); !bytes.Equal(hash[:], header[15:]) {
+		return h, nil, errCorruptShard
+	}
+	return h, shard, nil
+}
+
+// shardOf returns the key of the object a shard key belongs to, along with
+// the index of the shard.
+func shardOf(key string) (string, int, bool) {
+	i := strings.LastIndex(key, ".shard")
+	if i < 0 {
+		return key, 0, false
+	}
+	index, err := strconv.Atoi(key[i+len(".shard"):])
+	if err != nil {
+		return key, 0, false
+	}
+	return key[:i], index, true
+}
+
+// placement returns the peer each of the n shards of key goes to. Shards are
+// dealt out to the peers in turn, starting from a peer picked from the key so
+// that the first shards of every object don't all pile up on the same peer.
+func (s *FileServer) placement(key string, n int) []p2p.Peer {
+	peers := s.connectedPeers()
+
+	if len(peers) == 0 {
+		return nil
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].RemoteAddr().String() < peers[j].RemoteAddr().String()
+	})
+
+	hash := sha256.Sum256([]byte(key))
+	start := int(binary.LittleEndian.Uint32(hash[:4]) % uint32(len(peers)))
+
+	out := make([]p2p.Peer, n)
+	for i := range out {
+		out[i] = peers[(start+i)%len(peers)]
+	}
+	return out
+}
+
+// pushShards erasure codes the already encrypted object data and hands its
+// shards out to the peers, to be stored as shards of (id, key).
+func (s *FileServer) pushShards(tc TraceContext, id string, key string, meta Metadata, data []byte) error {
+	rs, err := newReedSolomon(s.DataShards, s.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	peers := s.placement(key, rs.shards())
+	if peers == nil {
+		return nil
+	}
+	s.peerLock.Lock()
+	held := len(s.peers)
+	s.peerLock.Unlock()
+	if held < rs.shards() {
+		s.Logger.Warn("too few peers to hold one shard each, some will hold more than one", "key", key, "peers", held, "shards", rs.shards())
+	}
+
+	header := shardHeader{
+		DataShards:   rs.dataShards,
+		ParityShards: rs.parityShards,
+		Size:         int64(len(data)),
+	}
+	for i, shard := range rs.split(data) {
+		header.Index = i
+		if err := s.pushShard(tc, peers[i], id, key, meta, header, shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileServer) pushShard(tc TraceContext, peer p2p.Peer, id string, key string, meta Metadata, h shardHeader, shard []byte) error {
+	buf := new(bytes.Buffer)
+	if err := writeShard(buf, h, shard); err != nil {
+		return err
+	}
+
+	meta.Key = shardKey(key, h.Index)
+	return s.pushTo(tc, peer, id, meta.Key, meta, buf.Bytes())
+}
+
+// collectShards gathers the shards of (id, key) from our own store and the
+// network, leaving the ones nobody holds nil. Unless all is set, it stops as
+// soon as there are enough of them to reconstruct the object.
+func (s *FileServer) collectShards(tc TraceContext, id string, key string, all bool) ([][]byte, shardHeader, bool) {
+	var (
+		shards [][]byte
+		header shardHeader
+		have   int
+		// total is a guess until the first shard tells how many there are.
+		total = s.DataShards + s.ParityShards
+	)
+
+	keep := func(r io.Reader) (int64, error) {
+		h, shard, err := readShard(r)
+		if err != nil {
+			s.Logger.Warn("dropping shard", "owner", id, "key", key, "err", err)
+			return 0, nil
+		}
+		if shards == nil {
+			header = h
+			total = h.DataShards + h.ParityShards
+			shards = make([][]byte, total)
+		}
+		if h.DataShards != header.DataShards || h.ParityShards != header.ParityShards || h.Size != header.Size || h.Index >= total {
+			s.Logger.Warn("dropping mismatched shard", "owner", id, "key", key, "index", h.Index)
+			return 0, nil
+		}
+		if shards[h.Index] == nil {
+			shards[h.Index] = shard
+			have++
+		}
+		return int64(len(shard)), nil
+	}
+
+	enough := func() bool {
+		if shards == nil {
+			return false
+		}
+		if all {
+			return have == total
+		}
+		return have >= header.DataShards
+	}
+
+	for i := 0; i < total && !enough(); i++ {
+		sk := shardKey(key, i)
+		if !s.store.Has(id, sk) {
+			continue
+		}
+		if _, r, err := s.store.Read(id, sk); err == nil {
+			keep(r)
+			if rc, ok := r.(io.Closer); ok {
+				rc.Close()
+			}
+		}
+	}
+	if enough() {
+		return shards, header, true
+	}
+
+	// Whatever is missing is asked for all at once: every peer answers with
+	// the shards it holds.
+	err := s.ask(tc, id, key, MessageGetShards{ID: id, Key: key, Shards: total}, func(r io.Reader) (int64, error) {
+		var n int64
+		for {
+			var size int64
+			if err := binary.Read(r, binary.LittleEndian, &size); err == io.EOF {
+				return n, nil
+			} else if err != nil {
+				return n, err
+			}
+			if size < 0 {
+				continue
+			}
+			lr := io.LimitReader(r, size)
+			m, err := keep(lr)
+			if err != nil {
+				return n, err
+			}
+			io.Copy(io.Discard, lr)
+			n += m
+		}
+	})
+	if err != nil {
+		s.Logger.Warn("fetching shards", "owner", id, "key", key, "err", err)
+	}
+
+	return shards, header, shards != nil
+}
+
+// MessageGetShards asks for the shards of the object (ID, Key) with an index
+// below Shards. It is answered with a single stream holding, for every one of
+// them, its size, -1 when the shard is not held, followed by the shard.
+type MessageGetShards struct {
+	ID     string
+	Key    string
+	Shards int
+}
+
+func (s *FileServer) handleMessageGetShards(tc TraceContext, from string, msg MessageGetShards) error {
+	start := time.Now()
+	s.Logger.Debug("peer asked for shards", "peer", from, "owner", msg.ID, "key", msg.Key)
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	s.lockStreams(tc)
+	defer s.streamLock.Unlock()
+
+	var (
+		buf  = new(bytes.Buffer)
+		held int
+	)
+	for i := 0; i < msg.Shards && i < maxShards; i++ {
+		id, key := s.resolveVersion(msg.ID, shardKey(msg.Key, i))
+		if !s.has(id, key) {
+			binary.Write(buf, binary.LittleEndian, int64(-1))
+			continue
+		}
+		_, r, err := s.store.Read(id, key)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+		binary.Write(buf, binary.LittleEndian, int64(len(b)))
+		buf.Write(b)
+		held++
+	}
+
+	size := int64(buf.Len())
+	if held == 0 {
+		// Let the peer know, so it doesn't wait on us forever.
+		size = -1
+		buf.Reset()
+	}
+
+	span := s.Tracer.Start(tc, "send")
+	defer s.streaming(peer)()
+	peer.Send([]byte{p2p.IncomingStream})
+	binary.Write(peer, binary.LittleEndian, size)
+	n, err := io.Copy(peer, buf)
+	span.SetAttrs("bytes", n, "shards", held)
+	span.End(err)
+	if err != nil {
+		return err
+	}
+
+	if held > 0 {
+		s.Logger.Info("served shards", "peer", from, "owner", msg.ID, "key", msg.Key, "shards", held, "bytes", n, "duration", time.Since(start))
+	}
+	return nil
+}
+
+// fetchShards reconstructs the object (id, key) from its shards. It reports
+// false if no shard of it could be found at all.
+func (s *FileServer) fetchShards(tc TraceContext, id string, key string) ([]byte, bool, error) {
+	shards, header, ok := s.collectShards(tc, id, key, false)
+	if !ok {
+		return nil, false, nil
+	}
+
+	rs, err := newReedSolomon(header.DataShards, header.ParityShards)
+	if err != nil {
+		return nil, true, err
+	}
+	if err := rs.reconstruct(shards); err != nil {
+		return nil, true, fmt.Errorf("[%s] reconstructing (%s): %w", s.Transport.Addr(), key, err)
+	}
+
+	data, err := rs.join(shards, header.Size)
+	return data, true, err
+}
+
+// Repair regenerates the shards of one of our objects that were lost, from
+// the ones left, and hands them back out to the peers. It returns how many
+// shards were regenerated.
+func (s *FileServer) Repair(key string) (int, error) {
+	if err := s.begin(); err != nil {
+		return 0, err
+	}
+	defer s.end()
+
+	if s.DataShards == 0 {
+		return 0, fmt.Errorf("repairing (%s): not running in erasure coding mode", key)
+	}
+
+	span := s.Tracer.Start(TraceContext{}, "Repair")
+	span.SetAttrs("key", key)
+	n, err := s.repair(span.Context(), key)
+	span.SetAttrs("shards", n)
+	span.End(err)
+	return n, err
+}
+
+func (s *FileServer) repair(tc TraceContext, key string) (int, error) {
+
+	meta, err := s.store.Stat(s.ID, key)
+	if err != nil {
+		meta = Metadata{}
+	}
+	if meta, err = s.wireMeta(key, meta); err != nil {
+		return 0, err
+	}
+
+	wire := s.wireKey(key)
+	n, data, err := s.repairShards(tc, s.ID, wire, meta)
+	if err != nil {
+		return n, err
+	}
+
+	// For a convergent object that was only the reference, the blob holding
+	// the content needs looking after too.
+	plaintext := new(bytes.Buffer)
+	if _, err := copyDecryptWith(s.objectKeys(wire), bytes.NewReader(data), plaintext); err != nil {
+		return n, err
+	}
+	br := bufio.NewReader(plaintext)
+	if !isConvergentRef(br) {
+		return n, nil
+	}
+	ref, err := readConvergentRef(br)
+	if err != nil {
+		return n, err
+	}
+
+	blobMeta := Metadata{
+		ContentType: "application/octet-stream",
+		Created:     meta.Created,
+	}
+	m, _, err := s.repairShards(tc, convergentID, ref.Blob, blobMeta)
+	return n + m, err
+}
+
+// repairShards regenerates the missing shards of (id, key) and returns how
+// many there were, along with the object itself.
+func (s *FileServer) repairShards(tc TraceContext, id string, key string, meta Metadata) (int, []byte, error) {
+	shards, header, ok := s.collectShards(tc, id, key, true)
+	if !ok {
+		return 0, nil, fmt.Errorf("[%s] repairing (%s): %w", s.Transport.Addr(), key, errTooFewShards)
+	}
+
+	var missing []int
+	for i, shard := range shards {
+		if shard == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	rs, err := newReedSolomon(header.DataShards, header.ParityShards)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := rs.reconstruct(shards); err != nil {
+		return 0, nil, fmt.Errorf("[%s] repairing (%s): %w", s.Transport.Addr(), key, err)
+	}
+
+	peers := s.placement(key, len(shards))
+	if len(missing) > 0 && len(peers) < len(shards) {
+		return 0, nil, fmt.Errorf("[%s] repairing (%s): %w", s.Transport.Addr(), key, errNoPeers)
+	}
+	for _, i := range missing {
+		h := header
+		h.Index = i
+		if err := s.pushShard(tc, peers[i], id, key, meta, h, shards[i]); err != nil {
+			return 0, nil, err
+		}
+		s.Logger.Info("regenerated shard", "peer", peers[i].RemoteAddr().String(), "owner", id, "key", key, "index", i, "bytes", len(shards[i]))
+	}
+
+	data, err := rs.join(shards, header.Size)
+	return len(missing), data, err
+}
+
+// RepairAll runs Repair over every object this node holds and returns how
+// many shards were regenerated in total.
+func (s *FileServer) RepairAll() (int, error) {
+	var (
+		opts = ListOpts{Limit: 100}
+		done int
+	)
+
+	for {
+		res, err := s.store.List(s.ID, opts)
+		if err != nil {
+			return done, err
+		}
+
+		for _, meta := range res.Entries {
+			n, err := s.Repair(meta.Key)
+			done += n
+			if err != nil {
+				s.Logger.Error("repairing object", "key", meta.Key, "err", err)
+			}
+		}
+
+		if res.Next == "" {
+			return done, nil
+		}
+		opts.After = res.Next
+	}
+}
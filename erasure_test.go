@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+	shards := rs.split(data)
+
+	// Any two shards may go missing.
+	for a := 0; a < rs.shards(); a++ {
+		for b := a + 1; b < rs.shards(); b++ {
+			lost := make([][]byte, len(shards))
+			copy(lost, shards)
+			lost[a], lost[b] = nil, nil
+
+			if err := rs.reconstruct(lost); err != nil {
+				t.Fatalf("lost %d and %d: %v", a, b, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(lost[i], shards[i]) {
+					t.Errorf("lost %d and %d: shard %d came back wrong", a, b, i)
+				}
+			}
+
+			out, err := rs.join(lost, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("lost %d and %d: joined data is wrong", a, b)
+			}
+		}
+	}
+
+	lost := make([][]byte, len(shards))
+	copy(lost, shards)
+	lost[0], lost[2], lost[5] = nil, nil, nil
+	if err := rs.reconstruct(lost); err != errTooFewShards {
+		t.Errorf("have %v want %v", err, errTooFewShards)
+	}
+}
+
+func TestShardHeader(t *testing.T) {
+	h := shardHeader{DataShards: 256, ParityShards: 0, Index: 255, Size: 1 << 40}
+
+	buf := new(bytes.Buffer)
+	if err := writeShard(buf, h, []byte("Foo not bar")); err != nil {
+		t.Fatal(err)
+	}
+	sealed := buf.Bytes()
+
+	have, shard, err := readShard(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have != h || string(shard) != "Foo not bar" {
+		t.Errorf("have %+v %q want %+v %q", have, shard, h, "Foo not bar")
+	}
+
+	sealed[len(sealed)-1] ^= 0x01
+	if _, _, err := readShard(bytes.NewReader(sealed)); err != errCorruptShard {
+		t.Errorf("have %v want %v", err, errCorruptShard)
+	}
+}
+
+func TestErasureCodedNodes(t *testing.T) {
+	var (
+		peers []*FileServer
+		errs  []chan error
+	)
+	start := func(s *FileServer) {
+		errc := make(chan error, 1)
+		go func() { errc <- s.Start() }()
+		errs = append(errs, errc)
+	}
+
+	var addrs []string
+	for i := 0; i < 4; i++ {
+		peer := newTestNode(t, freeAddr(t), nil)
+		start(peer)
+		peers = append(peers, peer)
+		addrs = append(addrs, peer.Transport.Addr())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	owner := newTestNode(t, freeAddr(t), nil, addrs...)
+	owner.DataShards, owner.ParityShards = 2, 2
+	start(owner)
+	waitFor(t, "the peers to connect", func() bool {
+		return len(owner.Peers()) == len(peers)
+	})
+
+	data := strings.Repeat("Foo not bar ", 1000)
+	if err := owner.Store("notes.txt", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	shardsHeld := func() int {
+		n := 0
+		for _, peer := range peers {
+			res, err := peer.store.List(owner.ID, ListOpts{})
+			if err == nil {
+				n += len(res.Entries)
+			}
+		}
+		return n
+	}
+	waitFor(t, "the shards", func() bool { return shardsHeld() == 4 })
+
+	// Losing as many peers as there are parity shards loses nothing.
+	for _, peer := range peers[:2] {
+		if err := peer.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peers = peers[2:]
+	waitFor(t, "the peers to be gone", func() bool {
+		return len(owner.Peers()) == len(peers)
+	})
+	if err := owner.store.Delete(owner.ID, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := owner.Get("notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != data {
+		t.Fatalf("have %d bytes want %d", len(got), len(data))
+	}
+
+	n, err := owner.Repair("notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("repaired %d shards want 2", n)
+	}
+	waitFor(t, "the regenerated shards", func() bool { return shardsHeld() == 4 })
+
+	owner.Stop()
+	for _, peer := range peers {
+		peer.Stop()
+	}
+	for _, errc := range errs {
+		if err := <-errc; err != nil {
+			t.Errorf("start returned %v", err)
+		}
+	}
+}
+
+func TestRepairWithoutPeers(t *testing.T) {
+	s := newTestNode(t, freeAddr(t), nil)
+	s.DataShards, s.ParityShards = 2, 2
+
+	// Enough shards to reconstruct the object, held by the node itself, and
+	// no peer to hand the missing ones to.
+	rs, err := newReedSolomon(s.DataShards, s.ParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("Foo not bar ", 100))
+	wire := s.wireKey("notes.txt")
+	for i, shard := range rs.split(data)[:2] {
+		buf := new(bytes.Buffer)
+		h := shardHeader{DataShards: 2, ParityShards: 2, Index: i, Size: int64(len(data))}
+		if err := writeShard(buf, h, shard); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.store.Write(s.ID, shardKey(wire, i), buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.Repair("notes.txt"); !errors.Is(err, errNoPeers) {
+		t.Errorf("have %v want %v", err, errNoPeers)
+	}
+}
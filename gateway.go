@@ -0,0 +1,796 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The gateway speaks enough of the S3 REST API for the usual tools and SDKs
+// to store objects on a node: PutObject, GetObject with Range, HeadObject,
+// DeleteObject, DeleteObjects, ListObjectsV2 and multipart uploads, on path
+// style URLs (http://host/bucket/key). Every bucket stands for the objects of
+// one owner ID, those of the FileServer it is mapped to.
+//
+// ETags are the SHA-256 checksums of the objects rather than MD5s, which
+// clients treat as opaque. Parts of multipart uploads are kept on disk until
+// the upload completes and are lost if the gateway is restarted in between.
+
+const (
+	s3Namespace       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys         = 1000
+	s3MaxParts        = 10000
+	defaultS3Region   = "us-east-1"
+	s3TimeFormat      = "2006-01-02T15:04:05.000Z"
+	defaultUploadsDir = "rvt-uploads"
+)
+
+type GatewayOpts struct {
+	// ListenAddr is the address the gateway listens on.
+	ListenAddr string
+	// Buckets maps the name of every bucket to the server holding its
+	// objects.
+	Buckets map[string]*FileServer
+	// AccessKey and SecretKey are the credentials requests have to be signed
+	// with, using AWS Signature Version 4. When they are left empty requests
+	// are not authenticated at all, and ListenAddr has to be a loopback
+	// address.
+	AccessKey string
+	SecretKey string
+	// Region is the region requests are signed for, us-east-1 when left
+	// empty.
+	Region string
+	// UploadDir is where the parts of multipart uploads are kept until the
+	// upload completes, a directory in the temp directory when left empty.
+	UploadDir string
+	// Logger is what the gateway logs to, nothing when left nil.
+	Logger *slog.Logger
+}
+
+// Gateway serves an S3 compatible API in front of one or more FileServers.
+type Gateway struct {
+	GatewayOpts
+
+	srv     *http.Server
+	started time.Time
+
+	addrLock sync.Mutex
+	addr     net.Addr
+
+	uploadLock sync.Mutex
+	uploads    map[string]*multipartUpload
+}
+
+func NewGateway(opts GatewayOpts) *Gateway {
+	if len(opts.Region) == 0 {
+		opts.Region = defaultS3Region
+	}
+	if len(opts.UploadDir) == 0 {
+		opts.UploadDir = filepath.Join(os.TempDir(), defaultUploadsDir)
+	}
+	if opts.Logger == nil {
+		opts.Logger = discardLogger()
+	}
+
+	g := &Gateway{
+		GatewayOpts: opts,
+		started:     time.Now().UTC(),
+		uploads:     make(map[string]*multipartUpload),
+	}
+	g.srv = &http.Server{Handler: g}
+	return g
+}
+
+// ListenAndServe listens on ListenAddr and serves requests until Close is called.
+func (g *Gateway) ListenAndServe() error {
+	if g.AccessKey == "" || g.SecretKey == "" {
+		if err := checkLoopback(g.ListenAddr); err != nil {
+			return fmt.Errorf("gateway without credentials: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", g.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	g.addrLock.Lock()
+	g.addr = ln.Addr()
+	g.addrLock.Unlock()
+
+	err = g.srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Addr returns the address the gateway listens on, nil until it does.
+func (g *Gateway) Addr() net.Addr {
+	g.addrLock.Lock()
+	defer g.addrLock.Unlock()
+	return g.addr
+}
+
+// Close stops serving and drops the multipart uploads that were never
+// completed.
+func (g *Gateway) Close() error {
+	err := g.srv.Close()
+
+	g.uploadLock.Lock()
+	defer g.uploadLock.Unlock()
+	for id, upload := range g.uploads {
+		os.RemoveAll(upload.dir)
+		delete(g.uploads, id)
+	}
+	return err
+}
+
+// s3Error is an error the way S3 reports it.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errS3AccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3BadDigest         = &s3Error{http.StatusBadRequest, "BadDigest", "The payload does not match the hash it was signed with"}
+	errS3InvalidArgument   = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	errS3InvalidPart       = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errS3InvalidPartOrder  = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errS3InvalidRange      = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable"}
+	errS3MalformedXML      = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+	errS3NoSuchBucket      = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errS3NoSuchKey         = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errS3NoSuchUpload      = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errS3NotImplemented    = &s3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported by the gateway"}
+	errS3SignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	errS3TimeSkewed        = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+)
+
+func (g *Gateway) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3err *s3Error
+	switch {
+	case errors.As(err, &s3err):
+	case errors.Is(err, os.ErrNotExist):
+		s3err = errS3NoSuchKey
+	default:
+		g.Logger.Error("gateway request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		s3err = &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3err.Status)
+		return
+	}
+
+	writeS3XML(w, s3err.Status, struct {
+		XMLName xml.Name `xml:"Error"`
+		*s3Error
+		Resource string
+	}{s3Error: s3err, Resource: r.URL.Path})
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := g.authenticate(r)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	r.Body = body
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			g.writeError(w, r, errS3NotImplemented)
+			return
+		}
+		g.listBuckets(w, r)
+		return
+	}
+
+	s, ok := g.Buckets[bucket]
+	if !ok {
+		g.writeError(w, r, errS3NoSuchBucket)
+		return
+	}
+
+	q := r.URL.Query()
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && q.Has("location"):
+			writeS3XML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Region  string   `xml:",chardata"`
+			}{Region: g.Region})
+		case r.Method == http.MethodGet && q.Get("list-type") == "2":
+			g.listObjects(w, r, bucket, s)
+		case r.Method == http.MethodPost && q.Has("delete"):
+			g.deleteObjects(w, r, s)
+		default:
+			g.writeError(w, r, errS3NotImplemented)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		switch {
+		case q.Has("uploadId"):
+			g.uploadPart(w, r, bucket, key)
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			g.writeError(w, r, errS3NotImplemented)
+		default:
+			g.putObject(w, r, s, key)
+		}
+	case http.MethodGet, http.MethodHead:
+		if q.Has("uploadId") {
+			g.writeError(w, r, errS3NotImplemented)
+			return
+		}
+		g.getObject(w, r, s, key)
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			g.abortUpload(w, r, bucket, key)
+			return
+		}
+		if err := s.Delete(key); err != nil {
+			g.writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			g.createUpload(w, r, bucket, key)
+		case q.Has("uploadId"):
+			g.completeUpload(w, r, bucket, s, key)
+		default:
+			g.writeError(w, r, errS3NotImplemented)
+		}
+	default:
+		g.writeError(w, r, errS3NotImplemented)
+	}
+}
+
+func etag(meta Metadata) string {
+	return `"` + meta.Checksum + `"`
+}
+
+func (g *Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	res := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID          string
+			DisplayName string
+		}
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace}
+
+	names := make([]string, 0, len(g.Buckets))
+	for name := range g.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res.Buckets = append(res.Buckets, bucket{name, g.started.Format(s3TimeFormat)})
+	}
+
+	writeS3XML(w, http.StatusOK, res)
+}
+
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, s *FileServer, key string) {
+	opts := PutOpts{ContentType: r.Header.Get("Content-Type")}
+	if err := s.StoreWithOpts(key, r.Body, opts); err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	meta, err := s.Stat(key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(meta))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, s *FileServer, key string) {
+	rd, err := s.Get(key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	if rc, ok := rd.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	meta, err := s.Stat(key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("ETag", etag(meta))
+	h.Set("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if meta.ContentType != "" {
+		h.Set("Content-Type", meta.ContentType)
+	}
+
+	start, length, partial, err := parseRange(r.Header.Get("Range"), meta.Size)
+	if err != nil {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Size))
+		g.writeError(w, r, err)
+		return
+	}
+
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, meta.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if start > 0 {
+		if seeker, ok := rd.(io.Seeker); ok {
+			_, err = seeker.Seek(start, io.SeekCurrent)
+		} else {
+			_, err = io.CopyN(io.Discard, rd, start)
+		}
+		if err != nil {
+			return
+		}
+	}
+	io.CopyN(w, rd, length)
+}
+
+// parseRange parses the Range header of a request for an object of size
+// bytes, returning where the range starts, how long it is and whether it is
+// only part of the object. Like S3, only a single range is served, and a
+// header it can't make sense of gets the whole object.
+func parseRange(header string, size int64) (int64, int64, bool, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+
+	// bytes=-n asks for the last n bytes.
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, size, false, nil
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, false, errS3InvalidRange
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errS3InvalidRange
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, size, false, nil
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3Key struct {
+	Key string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+func (g *Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string, s *FileServer) {
+	q := r.URL.Query()
+	res := listBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		EncodingType:      q.Get("encoding-type"),
+		MaxKeys:           s3MaxKeys,
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			g.writeError(w, r, errS3InvalidArgument)
+			return
+		}
+		res.MaxKeys = min(n, s3MaxKeys)
+	}
+
+	after := res.StartAfter
+	if res.ContinuationToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			g.writeError(w, r, errS3InvalidArgument)
+			return
+		}
+		after = string(b)
+	}
+
+	// Keys sharing a common prefix count as one, and the listing resumes
+	// after every key sharing it, which is what the prefix followed by the
+	// highest rune sorts after.
+	var (
+		lastPrefix string
+		resume     string
+		opts       = ListOpts{Prefix: res.Prefix, After: after, Limit: s3MaxKeys}
+	)
+list:
+	for {
+		page, err := s.List(s.ID, opts)
+		if err != nil {
+			g.writeError(w, r, err)
+			return
+		}
+
+		for _, meta := range page.Entries {
+			common := ""
+			if res.Delimiter != "" {
+				rest := strings.TrimPrefix(meta.Key, res.Prefix)
+				if i := strings.Index(rest, res.Delimiter); i >= 0 {
+					common = res.Prefix + rest[:i+len(res.Delimiter)]
+				}
+			}
+			if common != "" && common == lastPrefix {
+				continue
+			}
+
+			if res.KeyCount == res.MaxKeys {
+				res.IsTruncated = true
+				break list
+			}
+			res.KeyCount++
+
+			if common != "" {
+				lastPrefix, resume = common, common+string(utf8.MaxRune)
+				res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{common})
+				continue
+			}
+			resume = meta.Key
+			res.Contents = append(res.Contents, s3Object{
+				Key:          meta.Key,
+				LastModified: meta.Created.UTC().Format(s3TimeFormat),
+				ETag:         etag(meta),
+				Size:         meta.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+
+		if page.Next == "" {
+			break
+		}
+		opts.After = page.Next
+	}
+
+	if res.IsTruncated {
+		res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(resume))
+	}
+
+	if res.EncodingType == "url" {
+		res.Prefix = url.QueryEscape(res.Prefix)
+		res.Delimiter = url.QueryEscape(res.Delimiter)
+		res.StartAfter = url.QueryEscape(res.StartAfter)
+		for i := range res.Contents {
+			res.Contents[i].Key = url.QueryEscape(res.Contents[i].Key)
+		}
+		for i := range res.CommonPrefixes {
+			res.CommonPrefixes[i].Prefix = url.QueryEscape(res.CommonPrefixes[i].Prefix)
+		}
+	}
+
+	writeS3XML(w, http.StatusOK, res)
+}
+
+func (g *Gateway) deleteObjects(w http.ResponseWriter, r *http.Request, s *FileServer) {
+	var req struct {
+		Quiet  bool
+		Object []struct {
+			Key string
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		g.writeError(w, r, errS3MalformedXML)
+		return
+	}
+
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	res := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Deleted []s3Key  `xml:"Deleted"`
+		Error   []deleteError
+	}{Xmlns: s3Namespace}
+
+	for _, obj := range req.Object {
+		if err := s.Delete(obj.Key); err != nil {
+			res.Error = append(res.Error, deleteError{obj.Key, "InternalError", err.Error()})
+			continue
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, s3Key{obj.Key})
+		}
+	}
+
+	writeS3XML(w, http.StatusOK, res)
+}
+
+// multipartUpload is an upload in progress, its parts kept in dir.
+type multipartUpload struct {
+	bucket      string
+	key         string
+	contentType string
+	dir         string
+	parts       map[int]string
+}
+
+func partPath(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%05d", n))
+}
+
+// upload returns the upload in progress under id, which has to be one of key
+// in bucket.
+func (g *Gateway) upload(id string, bucket string, key string) (*multipartUpload, error) {
+	g.uploadLock.Lock()
+	defer g.uploadLock.Unlock()
+
+	upload, ok := g.uploads[id]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return nil, errS3NoSuchUpload
+	}
+	return upload, nil
+}
+
+func (g *Gateway) createUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	id := generateID()[:32]
+	upload := &multipartUpload{
+		bucket:      bucket,
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		dir:         filepath.Join(g.UploadDir, id),
+		parts:       make(map[int]string),
+	}
+	if err := os.MkdirAll(upload.dir, 0700); err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	g.uploadLock.Lock()
+	g.uploads[id] = upload
+	g.uploadLock.Unlock()
+
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	q := r.URL.Query()
+	upload, err := g.upload(q.Get("uploadId"), bucket, key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	n, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || n < 1 || n > s3MaxParts {
+		g.writeError(w, r, errS3InvalidArgument)
+		return
+	}
+
+	// Parts may be sent again, the last one sent is the one that counts.
+	tmp, err := os.CreateTemp(upload.dir, "part-*")
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), r.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), partPath(upload.dir, n))
+	}
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	tag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	g.uploadLock.Lock()
+	upload.parts[n] = tag
+	g.uploadLock.Unlock()
+
+	w.Header().Set("ETag", tag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *Gateway) abortUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	id := r.URL.Query().Get("uploadId")
+	upload, err := g.upload(id, bucket, key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	g.uploadLock.Lock()
+	delete(g.uploads, id)
+	g.uploadLock.Unlock()
+
+	os.RemoveAll(upload.dir)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket string, s *FileServer, key string) {
+	id := r.URL.Query().Get("uploadId")
+	upload, err := g.upload(id, bucket, key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	var req struct {
+		Part []struct {
+			PartNumber int
+			ETag       string
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&req); err != nil || len(req.Part) == 0 {
+		g.writeError(w, r, errS3MalformedXML)
+		return
+	}
+
+	g.uploadLock.Lock()
+	var readers []io.Reader
+	for i, part := range req.Part {
+		if i > 0 && part.PartNumber <= req.Part[i-1].PartNumber {
+			err = errS3InvalidPartOrder
+			break
+		}
+		tag, ok := upload.parts[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, `"`) != strings.Trim(tag, `"`) {
+			err = errS3InvalidPart
+			break
+		}
+		f, ferr := os.Open(partPath(upload.dir, part.PartNumber))
+		if ferr != nil {
+			err = ferr
+			break
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	g.uploadLock.Unlock()
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	opts := PutOpts{ContentType: upload.contentType}
+	if err := s.StoreWithOpts(key, io.MultiReader(readers...), opts); err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	g.uploadLock.Lock()
+	delete(g.uploads, id)
+	g.uploadLock.Unlock()
+	os.RemoveAll(upload.dir)
+
+	meta, err := s.Stat(key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag(meta),
+	})
+}
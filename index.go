@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	indexFileName = "index.log"
+	// minCompactRecords keeps small indexes from being rewritten over and over.
+	minCompactRecords = 1024
+)
+
+const (
+	indexOpPut = "put"
+	indexOpDel = "del"
+)
+
+// indexRecord is a single line of the index log.
+type indexRecord struct {
+	Op     string
+	ID     string
+	Key    string
+	Path   string    `json:",omitempty"`
+	Offset int64     `json:",omitempty"`
+	Meta   *Metadata `json:",omitempty"`
+}
+
+type indexEntry struct {
+	// Path is relative to the store root.
+	Path string
+	// Offset is where the object starts in Path, for backends that keep
+	// several objects in one file.
+	Offset int64
+	Meta   Metadata
+}
+
+// keyIndex maps (id, key) to where the object lives on disk along with its
+// metadata. It is kept in memory and persisted as an append-only log of JSON
+// records, which gets compacted once it holds mostly dead records.
+type keyIndex struct {
+	mu      sync.RWMutex
+	path    string
+	f       *os.File
+	entries map[string]map[string]indexEntry
+	// records is the number of records in the log, live or not.
+	records int
+	live    int
+}
+
+// openIndex loads the index log found in root, replaying every record. If
+// there is no log yet, it is rebuilt from the metadata sidecars older stores
+// left next to each object.
+func openIndex(root string) (*keyIndex, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	idx := &keyIndex{
+		path:    filepath.Join(root, indexFileName),
+		entries: make(map[string]map[string]indexEntry),
+	}
+
+	f, err := os.Open(idx.path)
+	switch {
+	case err == nil:
+		err = idx.replay(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		sidecars, err := idx.rebuild(root)
+		if err != nil {
+			return nil, err
+		}
+		if err := idx.rewrite(); err != nil {
+			return nil, err
+		}
+		for _, path := range sidecars {
+			os.Remove(path)
+		}
+	default:
+		return nil, err
+	}
+
+	idx.f, err = os.OpenFile(idx.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+func (idx *keyIndex) replay(f *os.File) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+
+	var good int64
+	for scanner.Scan() {
+		var rec indexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn last line is what a crash in the middle of an append
+			// looks like. Everything before it is still good, so cut it off
+			// before we start appending after it.
+			return os.Truncate(idx.path, good)
+		}
+		idx.apply(rec)
+		idx.records++
+		good += int64(len(scanner.Bytes())) + 1
+	}
+
+	return scanner.Err()
+}
+
+// rebuild fills the index from the metadata sidecars left next to each
+// object, and returns their paths so they can go once the log is written.
+func (idx *keyIndex) rebuild(root string) ([]string, error) {
+	var sidecars []string
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaFileExt) {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var meta Metadata
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return fmt.Errorf("rebuilding index from %s: %w", path, err)
+		}
+
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, metaFileExt))
+		if err != nil {
+			return err
+		}
+
+		idx.apply(indexRecord{Op: indexOpPut, ID: meta.Owner, Key: meta.Key, Path: rel, Meta: &meta})
+		sidecars = append(sidecars, path)
+		return nil
+	})
+
+	return sidecars, err
+}
+
+func (idx *keyIndex) apply(rec indexRecord) {
+	keys, ok := idx.entries[rec.ID]
+
+	switch rec.Op {
+	case indexOpPut:
+		if !ok {
+			keys = make(map[string]indexEntry)
+			idx.entries[rec.ID] = keys
+		}
+		if _, exists := keys[rec.Key]; !exists {
+			idx.live++
+		}
+		keys[rec.Key] = indexEntry{Path: rec.Path, Offset: rec.Offset, Meta: *rec.Meta}
+	case indexOpDel:
+		if _, exists := keys[rec.Key]; exists {
+			delete(keys, rec.Key)
+			idx.live--
+		}
+		if ok && len(keys) == 0 {
+			delete(idx.entries, rec.ID)
+		}
+	}
+}
+
+func (idx *keyIndex) append(rec indexRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := idx.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	idx.apply(rec)
+	idx.records++
+
+	if idx.records > minCompactRecords && idx.records > 2*idx.live {
+		return idx.compact()
+	}
+	return nil
+}
+
+func (idx *keyIndex) get(id string, key string) (indexEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	e, ok := idx.entries[id][key]
+	return e, ok
+}
+
+func (idx *keyIndex) put(id string, key string, e indexEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.append(indexRecord{Op: indexOpPut, ID: id, Key: key, Path: e.Path, Offset: e.Offset, Meta: &e.Meta})
+}
+
+func (idx *keyIndex) del(id string, key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.append(indexRecord{Op: indexOpDel, ID: id, Key: key})
+}
+
+// list returns the metadata of every key held for id, in no particular order.
+func (idx *keyIndex) list(id string) []Metadata {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	entries := make([]Metadata, 0, len(idx.entries[id]))
+	for _, e := range idx.entries[id] {
+		entries = append(entries, e.Meta)
+	}
+	return entries
+}
+
+// owners returns the IDs of the owners holding at least one key.
+func (idx *keyIndex) owners() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	ids := make([]string, 0, len(idx.entries))
+	for id, keys := range idx.entries {
+		if len(keys) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// each calls fn for every live entry of the index. fn must not call back into
+// the index.
+func (idx *keyIndex) each(fn func(id string, key string, e indexEntry)) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	for id, keys := range idx.entries {
+		for key, e := range keys {
+			fn(id, key, e)
+		}
+	}
+}
+
+// compact rewrites the log so it only holds the live entries.
+func (idx *keyIndex) compact() error {
+	if err := idx.f.Close(); err != nil {
+		return err
+	}
+	if err := idx.rewrite(); err != nil {
+		return err
+	}
+
+	var err error
+	idx.f, err = os.OpenFile(idx.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// rewrite writes the live entries to a fresh log and swaps it in place of the
+// old one.
+func (idx *keyIndex) rewrite() error {
+	tmp, err := os.CreateTemp(filepath.Dir(idx.path), indexFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for id, keys := range idx.entries {
+		for key, e := range keys {
+			meta := e.Meta
+			if err := enc.Encode(indexRecord{Op: indexOpPut, ID: id, Key: key, Path: e.Path, Offset: e.Offset, Meta: &meta}); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), idx.path); err != nil {
+		return err
+	}
+	idx.records = idx.live
+	return nil
+}
+
+func (idx *keyIndex) close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.f.Close()
+}
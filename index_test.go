@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreDeleteKeepsNeighbours(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root: t.TempDir(),
+		PathTransformFunc: func(key string) PathKey {
+			return PathKey{PathName: "shared/" + key, Filename: key}
+		},
+	})
+	id := generateID()
+
+	for _, key := range []string{"foo", "bar"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(id, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Has(id, "foo") {
+		t.Errorf("expected to NOT have key foo")
+	}
+	if !s.Has(id, "bar") {
+		t.Errorf("deleting foo removed bar as well")
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id, "shared", "foo")); !os.IsNotExist(err) {
+		t.Errorf("expected empty directory of foo to be pruned, have %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id, "shared", "bar", "bar")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyIndexReopen(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	id := generateID()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(id, "foo_3"); err != nil {
+		t.Fatal(err)
+	}
+	s.index.close()
+
+	// Simulate a crash in the middle of an append.
+	f, err := os.OpenFile(filepath.Join(root, indexFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Op":"put","ID":"`)
+	f.Close()
+
+	s = NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	if s.Has(id, "foo_3") {
+		t.Errorf("expected to NOT have key foo_3 after reopening")
+	}
+	meta, err := s.Stat(id, "foo_7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != int64(len("foo_7")) || len(meta.Checksum) == 0 {
+		t.Errorf("unexpected metadata after reopening %+v", meta)
+	}
+
+	if _, err := s.Write(id, "after_crash", bytes.NewReader([]byte("ok"))); err != nil {
+		t.Fatal(err)
+	}
+	s.index.close()
+
+	s = NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	if !s.Has(id, "after_crash") {
+		t.Errorf("record appended after a torn line was lost")
+	}
+}
+
+func TestKeyIndexCompact(t *testing.T) {
+	idx, err := openIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+
+	for i := 0; i < minCompactRecords; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		if err := idx.put("id", key, indexEntry{Path: key, Meta: Metadata{Key: key}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := idx.del("id", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if idx.records > minCompactRecords {
+		t.Errorf("expected the log to be compacted, it holds %d records", idx.records)
+	}
+	if _, ok := idx.get("id", "foo_1"); ok {
+		t.Errorf("deleted key survived compaction")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const keystoreFileName = "keystore.json"
+
+// Parameters of the argon2id key derivation, following the recommendations of
+// RFC 9106 for memory constrained environments.
+const (
+	keystoreKDFTime    = 3
+	keystoreKDFMemory  = 64 * 1024
+	keystoreKDFThreads = 4
+	keystoreSaltSize   = 16
+)
+
+var errWrongPassphrase = errors.New("keystore: wrong passphrase or corrupt keystore")
+
+type keystoreKDF struct {
+	Name    string
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+type keystoreKey struct {
+	ID      string
+	Created time.Time
+	// Wrapped is the key sealed with AES-GCM under the passphrase derived key,
+	// prefixed with its nonce.
+	Wrapped []byte
+}
+
+// keystoreFile is what the keystore looks like on disk.
+type keystoreFile struct {
+	KDF    keystoreKDF
+	Active string
+	Keys   []keystoreKey
+	// Name is the key names are hashed under before leaving the node. It is
+	// never rotated, or we would lose track of what we handed out.
+	Name *keystoreKey `json:",omitempty"`
+	// Signing is the seed of the ed25519 key capabilities are signed with.
+	Signing *keystoreKey `json:",omitempty"`
+}
+
+const (
+	nameKeyID    = "name"
+	signingKeyID = "signing"
+)
+
+// Keystore holds the encryption keys of a node. Keys are persisted wrapped
+// under a key derived from a passphrase, so a restarted node can still
+// decrypt the copies it handed out to its peers. Every encrypted object names
+// the key that sealed it, so older keys stay usable after a rotation.
+type Keystore struct {
+	mu sync.RWMutex
+	// path is empty for keystores that only live in memory.
+	path    string
+	kek     []byte
+	file    keystoreFile
+	keys    map[string][]byte
+	active  string
+	name    []byte
+	signing ed25519.PrivateKey
+}
+
+// OpenKeystore opens the keystore found under root, unlocking it with
+// passphrase. A keystore holding a single fresh key is created when there is
+// none yet.
+func OpenKeystore(root string, passphrase string) (*Keystore, error) {
+	ks := &Keystore{
+		path: filepath.Join(root, keystoreFileName),
+		keys: make(map[string][]byte),
+	}
+
+	b, err := os.ReadFile(ks.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := ks.create(passphrase); err != nil {
+			return nil, err
+		}
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &ks.file); err != nil {
+		return nil, fmt.Errorf("keystore: %w", err)
+	}
+	if ks.file.KDF.Name != "argon2id" {
+		return nil, fmt.Errorf("keystore: unsupported key derivation %q", ks.file.KDF.Name)
+	}
+
+	kdf := ks.file.KDF
+	ks.kek = argon2.IDKey([]byte(passphrase), kdf.Salt, kdf.Time, kdf.Memory, kdf.Threads, 32)
+
+	for _, k := range ks.file.Keys {
+		key, err := ks.unwrap(k)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[k.ID] = key
+	}
+	if _, ok := ks.keys[ks.file.Active]; !ok {
+		return nil, fmt.Errorf("keystore: active key %s is missing", ks.file.Active)
+	}
+	ks.active = ks.file.Active
+
+	if err := ks.openSecrets(); err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// openSecrets unwraps the name and signing keys, creating the ones missing
+// from keystores written before they existed.
+func (ks *Keystore) openSecrets() error {
+	var err error
+	if ks.name, err = ks.secret(nameKeyID, func(f *keystoreFile) **keystoreKey { return &f.Name }); err != nil {
+		return err
+	}
+
+	seed, err := ks.secret(signingKeyID, func(f *keystoreFile) **keystoreKey { return &f.Signing })
+	if err != nil {
+		return err
+	}
+	ks.signing = ed25519.NewKeyFromSeed(seed)
+
+	return nil
+}
+
+// secret unwraps the key held in the slot of the keystore file, generating and
+// persisting one first if the slot is empty.
+func (ks *Keystore) secret(id string, slot func(*keystoreFile) **keystoreKey) ([]byte, error) {
+	if k := *slot(&ks.file); k != nil {
+		return ks.unwrap(*k)
+	}
+
+	key := newEncryptionKey()
+	wrapped, err := ks.wrap(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file := ks.file
+	*slot(&file) = &keystoreKey{
+		ID:      id,
+		Created: time.Now().UTC(),
+		Wrapped: wrapped,
+	}
+	if err := ks.save(file); err != nil {
+		return nil, err
+	}
+
+	ks.file = file
+	return key, nil
+}
+
+// newMemoryKeystore returns a keystore holding only key, which is never
+// written anywhere.
+func newMemoryKeystore(key []byte) *Keystore {
+	id := keyID(key)
+
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+
+	return &Keystore{
+		keys:    map[string][]byte{id: key},
+		active:  id,
+		name:    derive("rivulet name key"),
+		signing: ed25519.NewKeyFromSeed(derive("rivulet signing key")),
+	}
+}
+
+func (ks *Keystore) create(passphrase string) error {
+	salt := make([]byte, keystoreSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	ks.file.KDF = keystoreKDF{
+		Name:    "argon2id",
+		Salt:    salt,
+		Time:    keystoreKDFTime,
+		Memory:  keystoreKDFMemory,
+		Threads: keystoreKDFThreads,
+	}
+	ks.kek = argon2.IDKey([]byte(passphrase), salt, keystoreKDFTime, keystoreKDFMemory, keystoreKDFThreads, 32)
+
+	if _, err := ks.Rotate(); err != nil {
+		return err
+	}
+	return ks.openSecrets()
+}
+
+func (ks *Keystore) wrap(id string, key []byte) ([]byte, error) {
+	aead, err := newGCM(ks.kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	// Binding the ID keeps wrapped keys from being swapped around.
+	return aead.Seal(nonce, nonce, key, []byte(id)), nil
+}
+
+func (ks *Keystore) unwrap(k keystoreKey) ([]byte, error) {
+	aead, err := newGCM(ks.kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Wrapped) < aead.NonceSize() {
+		return nil, errWrongPassphrase
+	}
+
+	nonce, sealed := k.Wrapped[:aead.NonceSize()], k.Wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, []byte(k.ID))
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return key, nil
+}
+
+// Active returns the key new objects are encrypted with.
+func (ks *Keystore) Active() []byte {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.keys[ks.active]
+}
+
+// NameKey returns the key names are hashed under, see hashKey.
+func (ks *Keystore) NameKey() []byte {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.name
+}
+
+// SigningKey returns the key capabilities handed out by this node are signed
+// with.
+func (ks *Keystore) SigningKey() ed25519.PrivateKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.signing
+}
+
+// IDs returns the IDs of every key held, the retired ones included.
+func (ks *Keystore) IDs() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ActiveID returns the ID of the active key.
+func (ks *Keystore) ActiveID() string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.active
+}
+
+// Key returns the key with the given ID. The empty ID stands for the active
+// key, which is what objects written before key IDs existed were sealed with.
+func (ks *Keystore) Key(id string) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if id == "" {
+		id = ks.active
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownKey, id)
+	}
+	return key, nil
+}
+
+// Rotate generates a new key, makes it the active one and persists the
+// keystore. Older keys are kept so existing objects can still be decrypted.
+func (ks *Keystore) Rotate() (string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key := newEncryptionKey()
+	id := keyID(key)
+
+	if ks.path != "" {
+		wrapped, err := ks.wrap(id, key)
+		if err != nil {
+			return "", err
+		}
+
+		file := ks.file
+		file.Keys = append(append([]keystoreKey(nil), file.Keys...), keystoreKey{
+			ID:      id,
+			Created: time.Now().UTC(),
+			Wrapped: wrapped,
+		})
+		file.Active = id
+
+		if err := ks.save(file); err != nil {
+			return "", err
+		}
+		ks.file = file
+	}
+
+	ks.keys[id] = key
+	ks.active = id
+	return id, nil
+}
+
+// save atomically replaces the keystore on disk with file.
+func (ks *Keystore) save(file keystoreFile) error {
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ks.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := ks.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
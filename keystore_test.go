@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeystore(t *testing.T) {
+	root := t.TempDir()
+
+	ks, err := OpenKeystore(root, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := ks.ActiveID()
+	nameKey := ks.NameKey()
+
+	sealed := new(bytes.Buffer)
+	if _, err := copyEncrypt(ks.Active(), bytes.NewReader([]byte("Foo not bar")), sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	newID, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == oldID {
+		t.Fatalf("rotation kept the same key %s", newID)
+	}
+
+	// A restarted node unlocks the same keys and can still read objects
+	// sealed before the rotation.
+	ks, err = OpenKeystore(root, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.ActiveID() != newID {
+		t.Errorf("have active key %s want %s", ks.ActiveID(), newID)
+	}
+	// The names handed out before the restart have to hash the same way.
+	if !bytes.Equal(ks.NameKey(), nameKey) {
+		t.Errorf("name key changed across restarts")
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecryptWith(ks.Key, bytes.NewReader(sealed.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Foo not bar" {
+		t.Errorf("decryption failed!!!")
+	}
+
+	if _, err := OpenKeystore(root, "hunter3"); !errors.Is(err, errWrongPassphrase) {
+		t.Errorf("have %v want %v", err, errWrongPassphrase)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+type memoryObject struct {
+	data []byte
+	meta Metadata
+}
+
+// MemoryStore keeps every object in memory. It is meant for tests and short
+// lived nodes, nothing survives a restart.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]map[string]memoryObject
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		objects: make(map[string]map[string]memoryObject),
+	}
+}
+
+func (s *MemoryStore) Has(id string, key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.objects[id][key]
+	return ok
+}
+
+func (s *MemoryStore) Read(id string, key string) (int64, io.Reader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[id][key]
+	if !ok {
+		return 0, nil, fmt.Errorf("read %s: %w", key, os.ErrNotExist)
+	}
+
+	return int64(len(obj.data)), bytes.NewReader(obj.data), nil
+}
+
+func (s *MemoryStore) Write(id string, key string, r io.Reader) (int64, error) {
+	return s.WriteWithMeta(id, key, Metadata{}, r)
+}
+
+func (s *MemoryStore) WriteWithMeta(id string, key string, meta Metadata, r io.Reader) (int64, error) {
+	var (
+		buf = new(bytes.Buffer)
+		mw  = newMetaWriter()
+	)
+
+	n, err := io.Copy(io.MultiWriter(buf, mw), r)
+	if err != nil {
+		return n, err
+	}
+
+	meta.Key = key
+	meta.Owner = id
+	mw.fill(&meta)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, ok := s.objects[id]
+	if !ok {
+		keys = make(map[string]memoryObject)
+		s.objects[id] = keys
+	}
+	keys[key] = memoryObject{data: buf.Bytes(), meta: meta}
+
+	return n, nil
+}
+
+func (s *MemoryStore) Delete(id string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects[id], key)
+	if len(s.objects[id]) == 0 {
+		delete(s.objects, id)
+	}
+	return nil
+}
+
+func (s *MemoryStore) List(id string, opts ListOpts) (ListResult, error) {
+	s.mu.RLock()
+	entries := make([]Metadata, 0, len(s.objects[id]))
+	for _, obj := range s.objects[id] {
+		entries = append(entries, obj.meta)
+	}
+	s.mu.RUnlock()
+
+	return paginate(entries, opts), nil
+}
+
+func (s *MemoryStore) Owners() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.objects))
+	for id := range s.objects {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *MemoryStore) Stat(id string, key string) (Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[id][key]
+	if !ok {
+		return Metadata{}, fmt.Errorf("stat %s: %w", key, os.ErrNotExist)
+	}
+	return obj.meta, nil
+}
+
+func (s *MemoryStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects = make(map[string]map[string]memoryObject)
+	return nil
+}
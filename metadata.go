@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"time"
+)
+
+// Metadata describes a stored object. CASPathTransformFunc is one-way, so this
+// record is the only place the original key name survives.
+type Metadata struct {
+	Key         string
+	Owner       string
+	Size        int64
+	ContentType string
+	// Checksum is the hex encoded SHA-256 of the bytes held on disk.
+	Checksum string
+	Created  time.Time
+	// Version orders the writes of a key, see nextVersion.
+	Version uint64
+	// Clock tells which writes of the key the node writing this version knew
+	// of, and Node is that node.
+	Clock VectorClock `json:",omitempty"`
+	Node  string      `json:",omitempty"`
+	// Sibling is set on a version that lost a conflict but is kept anyway,
+	// see KeepSiblings.
+	Sibling bool `json:",omitempty"`
+	// Expires is when the object is due to be swept away. The zero time means
+	// never.
+	Expires time.Time
+	// SealedName is set on replicas, whose Key is only the hashed name. It
+	// holds the real name encrypted under the owner's key, see sealName.
+	SealedName []byte `json:",omitempty"`
+	// From is set on what we hold on behalf of other owners, to the host of
+	// the peer it came from, which it is charged to, see usageLedger.
+	From string `json:",omitempty"`
+}
+
+// expired reports whether the object is past its expiry at now.
+func (m Metadata) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// metaWriter sits next to the file being written and collects everything we
+// need to fill in a Metadata record once the copy is done.
+type metaWriter struct {
+	hash  hash.Hash
+	sniff []byte
+	n     int64
+}
+
+func newMetaWriter() *metaWriter {
+	return &metaWriter{
+		hash:  sha256.New(),
+		sniff: make([]byte, 0, 512),
+	}
+}
+
+func (w *metaWriter) Write(b []byte) (int, error) {
+	if room := cap(w.sniff) - len(w.sniff); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		w.sniff = append(w.sniff, b[:room]...)
+	}
+	w.n += int64(len(b))
+	return w.hash.Write(b)
+}
+
+// fill completes meta with what was observed while writing. Fields the caller
+// already set (e.g. a replica receiving metadata from the owner) are kept.
+func (w *metaWriter) fill(meta *Metadata) {
+	meta.Size = w.n
+	meta.Checksum = hex.EncodeToString(w.hash.Sum(nil))
+	if meta.ContentType == "" {
+		meta.ContentType = http.DetectContentType(w.sniff)
+	}
+	if meta.Created.IsZero() {
+		meta.Created = time.Now().UTC()
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are served in the Prometheus text exposition format. What the
+// server counts as it goes is kept in serverMetrics, the rest, such as the
+// size of the store or the bytes carried by every peer connection, is read
+// when the metrics are scraped.
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+	// operation latency histogram.
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// lagBuckets are those of the replication lag histogram.
+	lagBuckets = []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}
+)
+
+// serverMetrics is what a FileServer counts about itself.
+type serverMetrics struct {
+	// ops is the latency of Store, Get, Delete and List, by operation and
+	// outcome.
+	ops *histogramVec
+	// replicationLag is how long after they were written on their owner the
+	// replicas we store reach us.
+	replicationLag *histogramVec
+	// decodeErrors counts the messages of peers that made it through the
+	// transport but could not be decoded.
+	decodeErrors atomic.Int64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		ops:            newHistogramVec(latencyBuckets, "op", "outcome"),
+		replicationLag: newHistogramVec(lagBuckets),
+	}
+}
+
+// observe records how an operation that started at start went, outcome being
+// told by err.
+func (m *serverMetrics) observe(op string, start time.Time, err error) {
+	outcome := "ok"
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		outcome = "not_found"
+	case err != nil:
+		outcome = "error"
+	}
+	m.ops.observe(time.Since(start).Seconds(), op, outcome)
+}
+
+// peerCounter is implemented by peers keeping count of the bytes they carry,
+// such as p2p.TCPPeer.
+type peerCounter interface {
+	BytesRead() int64
+	BytesWritten() int64
+}
+
+// decodeCounter is implemented by transports keeping count of the messages
+// they failed to decode, such as p2p.TCPTransport.
+type decodeCounter interface {
+	DecodeErrors() int64
+}
+
+// WriteMetrics writes the metrics of the server to w in the Prometheus text
+// exposition format.
+func (s *FileServer) WriteMetrics(w io.Writer) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	peers := s.peerStatus()
+
+	mw.header("rivulet_peers", "gauge", "Number of peers the node is connected to.")
+	mw.sample("rivulet_peers", nil, float64(len(peers)))
+
+	mw.header("rivulet_peer_received_bytes_total", "counter", "Bytes received from every connected peer.")
+	for _, p := range peers {
+		mw.sample("rivulet_peer_received_bytes_total", []string{"peer", p.Addr}, float64(p.BytesReceived))
+	}
+	mw.header("rivulet_peer_sent_bytes_total", "counter", "Bytes sent to every connected peer.")
+	for _, p := range peers {
+		mw.sample("rivulet_peer_sent_bytes_total", []string{"peer", p.Addr}, float64(p.BytesSent))
+	}
+
+	mw.header("rivulet_operation_duration_seconds", "histogram", "Latency of Store, Get, Delete and List by outcome.")
+	s.metrics.ops.write(mw, "rivulet_operation_duration_seconds")
+
+	mw.header("rivulet_replication_lag_seconds", "histogram", "Time between an object being written on its owner and its replica being stored here.")
+	s.metrics.replicationLag.write(mw, "rivulet_replication_lag_seconds")
+
+	mw.header("rivulet_decode_errors_total", "counter", "Messages from peers that failed to decode, by layer.")
+	if t, ok := s.Transport.(decodeCounter); ok {
+		mw.sample("rivulet_decode_errors_total", []string{"layer", "transport"}, float64(t.DecodeErrors()))
+	}
+	mw.sample("rivulet_decode_errors_total", []string{"layer", "message"}, float64(s.metrics.decodeErrors.Load()))
+
+	objects, size, err := s.storeSize()
+	if err == nil {
+		mw.header("rivulet_store_objects", "gauge", "Number of objects held in the store, replicas and versions included.")
+		mw.sample("rivulet_store_objects", nil, float64(objects))
+		mw.header("rivulet_store_bytes", "gauge", "Bytes held in the store.")
+		mw.sample("rivulet_store_bytes", nil, float64(size))
+	}
+
+	if ferr := mw.w.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// storeSize returns how many objects the store holds and their size.
+func (s *FileServer) storeSize() (int, int64, error) {
+	owners, err := s.store.Owners()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		objects int
+		size    int64
+	)
+	for _, id := range owners {
+		opts := ListOpts{Limit: 1000}
+		for {
+			res, err := s.store.List(id, opts)
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, meta := range res.Entries {
+				objects++
+				size += meta.Size
+			}
+			if res.Next == "" {
+				break
+			}
+			opts.After = res.Next
+		}
+	}
+	return objects, size, nil
+}
+
+// histogramVec is a histogram split by the values of its labels.
+type histogramVec struct {
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		buckets: buckets,
+		labels:  labels,
+		series:  make(map[string]*histogram),
+	}
+}
+
+// observe records v in the series of the given label values.
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(mw *metricsWriter, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		labels := make([]string, 0, 2*len(h.labels)+2)
+		for i, label := range h.labels {
+			labels = append(labels, label, s.values[i])
+		}
+
+		for i, bound := range h.buckets {
+			mw.sample(name+"_bucket", append(labels, "le", formatFloat(bound)), float64(s.counts[i]))
+		}
+		mw.sample(name+"_bucket", append(labels, "le", "+Inf"), float64(s.count))
+		mw.sample(name+"_sum", labels, s.sum)
+		mw.sample(name+"_count", labels, float64(s.count))
+	}
+}
+
+// metricsWriter writes metrics in the text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) header(name string, typ string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample, labels being pairs of names and values.
+func (mw *metricsWriter) sample(name string, labels []string, v float64) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteByte(' ')
+	mw.w.WriteString(formatFloat(v))
+	mw.w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type MetricsOpts struct {
+	// ListenAddr is the address the metrics are served on, at /metrics.
+	// Anyone reaching it can scrape them, and they tell about the peers of
+	// the node and how much every owner stores on it, so it has to be a
+	// loopback address unless Public is set.
+	ListenAddr string
+	Public     bool
+	Server     *FileServer
+}
+
+// Metrics serves the metrics of a FileServer over HTTP, for Prometheus to
+// scrape.
+type Metrics struct {
+	MetricsOpts
+
+	srv *http.Server
+
+	addrLock sync.Mutex
+	addr     net.Addr
+}
+
+func NewMetrics(opts MetricsOpts) *Metrics {
+	m := &Metrics{
+		MetricsOpts: opts,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", m.handleMetrics)
+	m.srv = &http.Server{Handler: mux}
+	return m
+}
+
+func (m *Metrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := m.Server.WriteMetrics(w); err != nil {
+		m.Server.Logger.Error("writing metrics", "err", err)
+	}
+}
+
+// ListenAndServe listens on ListenAddr and serves the metrics until Close is
+// called.
+func (m *Metrics) ListenAndServe() error {
+	if !m.Public {
+		if err := checkLoopback(m.ListenAddr); err != nil {
+			return fmt.Errorf("metrics: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", m.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	m.addrLock.Lock()
+	m.addr = ln.Addr()
+	m.addrLock.Unlock()
+
+	err = m.srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Addr returns the address the metrics are served on, nil until they are.
+func (m *Metrics) Addr() net.Addr {
+	m.addrLock.Lock()
+	defer m.addrLock.Unlock()
+	return m.addr
+}
+
+// Close stops serving.
+func (m *Metrics) Close() error {
+	return m.srv.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+// sampleLine is a sample line of the text exposition format.
+var sampleLine = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{([a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*",?)*\})? (\+Inf|-Inf|NaN|[-+0-9.eE]+)$`)
+
+// parseMetrics checks every line of the metrics in b and returns the samples
+// by name and labels, as they are written.
+func parseMetrics(t *testing.T, b []byte) map[string]float64 {
+	t.Helper()
+
+	samples := make(map[string]float64)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		if !sampleLine.MatchString(line) {
+			t.Errorf("malformed line %q", line)
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, _ := strconv.ParseFloat(line[i+1:], 64)
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	if err := b.Store("notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get("missing"); err == nil {
+		t.Fatal("got a key never stored")
+	}
+	waitFor(t, "the replica", func() bool {
+		res, err := a.store.List(b.ID, ListOpts{})
+		return err == nil && len(res.Entries) == 1
+	})
+
+	buf := new(bytes.Buffer)
+	if err := b.WriteMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+	samples := parseMetrics(t, buf.Bytes())
+	for name, want := range map[string]float64{
+		`rivulet_peers`: 1,
+		`rivulet_operation_duration_seconds_count{op="store",outcome="ok"}`:            1,
+		`rivulet_operation_duration_seconds_count{op="get",outcome="not_found"}`:       1,
+		`rivulet_operation_duration_seconds_bucket{op="store",outcome="ok",le="+Inf"}`: 1,
+		`rivulet_store_objects`:                        1,
+		`rivulet_store_bytes`:                          5,
+		`rivulet_decode_errors_total{layer="message"}`: 0,
+	} {
+		if have, ok := samples[name]; !ok || have != want {
+			t.Errorf("%s: have %v (present %v) want %v", name, have, ok, want)
+		}
+	}
+	var sent bool
+	for name, v := range samples {
+		if strings.HasPrefix(name, "rivulet_peer_sent_bytes_total{") && v > 0 {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Errorf("no bytes sent to the peer in\n%s", buf)
+	}
+
+	// a got the replica, and knows how late it was, over HTTP.
+	ts := httptest.NewServer(NewMetrics(MetricsOpts{Server: a}).srv.Handler)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	buf.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != metricsContentType {
+		t.Errorf("content type: have %q want %q", resp.Header.Get("Content-Type"), metricsContentType)
+	}
+	samples = parseMetrics(t, buf.Bytes())
+	if samples["rivulet_replication_lag_seconds_count"] != 1 {
+		t.Errorf("replication lag not observed in\n%s", buf)
+	}
+
+	b.Stop()
+	a.Stop()
+	<-aErr
+	<-bErr
+}
+
+func TestMetricsListen(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:   NewMemoryStore(),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+
+	if err := NewMetrics(MetricsOpts{ListenAddr: "0.0.0.0:0", Server: s}).ListenAndServe(); err == nil {
+		t.Error("metrics served on a non-loopback address")
+	}
+
+	for _, opts := range []MetricsOpts{
+		{ListenAddr: "127.0.0.1:0", Server: s},
+		{ListenAddr: "0.0.0.0:0", Public: true, Server: s},
+	} {
+		m := NewMetrics(opts)
+		go m.ListenAndServe()
+		waitFor(t, "the metrics of "+opts.ListenAddr, func() bool {
+			return m.Addr() != nil
+		})
+		m.Close()
+	}
+}
+
+func TestMetricsWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	mw := &metricsWriter{w: bufio.NewWriter(buf)}
+
+	h := newHistogramVec([]float64{1, 5}, "op")
+	h.observe(0.5, "get")
+	h.observe(3, "get")
+	h.observe(10, "get")
+	h.write(mw, "latency")
+	mw.sample("odd", []string{"peer", "a\"b\\c\nd"}, 1)
+	mw.w.Flush()
+
+	want := `latency_bucket{op="get",le="1"} 1
+latency_bucket{op="get",le="5"} 2
+latency_bucket{op="get",le="+Inf"} 3
+latency_sum{op="get"} 13.5
+latency_count{op="get"} 3
+odd{peer="a\"b\\c\nd"} 1
+`
+	if buf.String() != want {
+		t.Errorf("have\n%s\nwant\n%s", buf, want)
+	}
+	parseMetrics(t, buf.Bytes())
+}
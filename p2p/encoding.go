@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -20,7 +22,7 @@ type DefaultDecoder struct{}
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 	peekBuf := make([]byte, 1)
 	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+		return err
 	}
 
 	// In case of a an in coming stream, we do not need to deocode what is sent
@@ -30,12 +32,28 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return nil
 	}
 
-	buf := make([]byte, 1028)
+	// Messages are prefixed with their length so a payload never gets cut short
+	// or merged with whatever the peer sends right after it.
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the %d bytes limit", size, MaxMessageSize)
+	}
 
-	n, err := r.Read(buf)
-	if err != nil {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
-	msg.Payload = buf[:n]
+	msg.Payload = buf
 	return nil
 }
+
+// EncodeMessage frames payload the way DefaultDecoder expects it.
+func EncodeMessage(payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+	return append(buf, payload...)
+}
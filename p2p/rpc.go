@@ -5,6 +5,9 @@ const (
 	IncomingStream  = 0x2
 )
 
+// MaxMessageSize is the largest message payload a peer is allowed to send.
+const MaxMessageSize = 4 << 20
+
 // Message holds arbitrary data that is sent over each transport between two nodes.
 type RPC struct {
 	From    string
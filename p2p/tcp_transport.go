@@ -1,11 +1,14 @@
 package p2p
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // TCPPeer represents the remote node over an established TCP connection
@@ -15,18 +18,43 @@ type TCPPeer struct {
 	// If we dial a peer and retrieve a connectin => outbound == true
 	// if we accept from a peer and retrieve a connection => outbound == false
 	outbound bool
+	// connectedAt is when the connection was established.
+	connectedAt time.Time
 
-	wg *sync.WaitGroup
+	// stream is signalled by CloseStream once whoever is reading a stream
+	// off the connection is done with it. streaming is set until then.
+	stream    chan struct{}
+	streaming atomic.Bool
+
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
-		Conn:     conn,
-		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		Conn:        conn,
+		outbound:    outbound,
+		connectedAt: time.Now(),
+		stream:      make(chan struct{}, 1),
 	}
 }
 
+// Outbound reports whether we dialed the peer, rather than it dialing us.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// ConnectedAt returns when the connection with the peer was established.
+func (p *TCPPeer) ConnectedAt() time.Time {
+	return p.connectedAt
+}
+
+// Streaming reports whether a stream from the peer is being read off the
+// connection.
+func (p *TCPPeer) Streaming() bool {
+	return p.streaming.Load()
+}
+
 // // Close implements the Peer interface.
 // func (p *TCPPeer) Close() error {
 // 	return p.conn.Close()
@@ -39,31 +67,75 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 // }
 
 func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	select {
+	case p.stream <- struct{}{}:
+	default:
+	}
+}
+
+func (p *TCPPeer) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	p.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	n, err := p.Conn.Write(b)
+	p.bytesWritten.Add(int64(n))
+	return n, err
 }
 
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
+	_, err := p.Write(b)
 	return err
 }
 
+// BytesRead returns how many bytes were read from the peer so far.
+func (p *TCPPeer) BytesRead() int64 {
+	return p.bytesRead.Load()
+}
+
+// BytesWritten returns how many bytes were written to the peer so far.
+func (p *TCPPeer) BytesWritten() int64 {
+	return p.bytesWritten.Load()
+}
+
 type TCPTransportOpts struct {
 	ListenAddr    string
 	HandShakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// Logger is what the transport logs to, nothing when left nil.
+	Logger *slog.Logger
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
+
+	// closed is closed along with the transport. Close then closes every
+	// connection in conns and waits for the goroutines in wg.
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	connLock  sync.Mutex
+	conns     map[net.Conn]struct{}
+
+	decodeErrors atomic.Int64
 }
 
 func NewTCPTransport(tcptransferOpts TCPTransportOpts) *TCPTransport {
+	if tcptransferOpts.Logger == nil {
+		tcptransferOpts.Logger = slog.New(slog.DiscardHandler)
+	}
+	tcptransferOpts.Logger = tcptransferOpts.Logger.With("node", tcptransferOpts.ListenAddr)
+
 	return &TCPTransport{
 		TCPTransportOpts: tcptransferOpts,
 		rpcch:            make(chan RPC, 1024),
+		closed:           make(chan struct{}),
+		conns:            make(map[net.Conn]struct{}),
 	}
 }
 
@@ -79,53 +151,132 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcch
 }
 
-// Close implements the transport interface. It closes the connection set up for transport
+// Close implements the transport interface. It stops accepting connections,
+// closes every connection and returns once all the goroutines of the
+// transport have exited.
 func (t *TCPTransport) Close() error {
-	return t.listener.Close()
+	var err error
+	t.closeOnce.Do(func() {
+		t.connLock.Lock()
+		close(t.closed)
+		if t.listener != nil {
+			err = t.listener.Close()
+		}
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.connLock.Unlock()
+	})
+
+	t.wg.Wait()
+	return err
 }
 
 func (t *TCPTransport) ListeAddr() string {
 	return t.ListenAddr
 }
 
+// DecodeErrors returns how many messages from peers failed to decode.
+func (t *TCPTransport) DecodeErrors() int64 {
+	return t.decodeErrors.Load()
+}
+
 // Dial implements the transport interface
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	// Closing the transport gives up on a dial still in progress.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Dialed ", conn.RemoteAddr().String())
+	t.Logger.Info("dialed peer", "peer", conn.RemoteAddr().String())
 
+	if !t.track(conn) {
+		conn.Close()
+		return net.ErrClosed
+	}
 	go t.handleConnection(conn, true)
 	return nil
 }
 
+// track registers conn, and the goroutine about to handle it, with the
+// transport. It fails once the transport is closed.
+func (t *TCPTransport) track(conn net.Conn) bool {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	select {
+	case <-t.closed:
+		return false
+	default:
+	}
+
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *TCPTransport) untrack(conn net.Conn) {
+	t.connLock.Lock()
+	delete(t.conns, conn)
+	t.connLock.Unlock()
+
+	t.wg.Done()
+}
+
 func (t *TCPTransport) ListenAndAccept() error {
 	var err error
 
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	select {
+	case <-t.closed:
+		return net.ErrClosed
+	default:
+	}
+
 	t.listener, err = net.Listen("tcp", t.ListenAddr)
 	if err != nil {
 		return err
 	}
 
+	t.wg.Add(1)
 	go t.startAcceptLoop()
 
-	log.Printf("TCP transport listening on port: %s\n", t.ListenAddr)
+	t.Logger.Info("listening for peers", "addr", t.listener.Addr().String())
 
 	return nil
 }
 
 func (t *TCPTransport) startAcceptLoop() {
+	defer t.wg.Done()
+
 	for {
 		conn, err := t.listener.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			fmt.Printf("TCP accept error: %v\n", err)
+			t.Logger.Error("accepting connection", "err", err)
+			continue
 		}
 
+		if !t.track(conn) {
+			conn.Close()
+			return
+		}
 		go t.handleConnection(conn, false)
 	}
 }
@@ -133,9 +284,16 @@ func (t *TCPTransport) startAcceptLoop() {
 func (t *TCPTransport) handleConnection(conn net.Conn, outbound bool) {
 	var err error
 
+	log := t.Logger.With("peer", conn.RemoteAddr().String())
 	defer func() {
-		fmt.Printf("dropping peer connection: %s\n", err)
 		conn.Close()
+		t.untrack(conn)
+
+		if err == nil || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+			log.Info("peer disconnected")
+		} else {
+			log.Warn("dropping peer connection", "err", err)
+		}
 	}()
 
 	peer := NewTCPPeer(conn, outbound)
@@ -151,32 +309,40 @@ func (t *TCPTransport) handleConnection(conn net.Conn, outbound bool) {
 
 	for {
 		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
+		err = t.Decoder.Decode(peer, &rpc)
 		if err != nil {
-			// if strings.Contains(err.Error(), "use of closed network connection") {
-			// 	fmt.Println("Peer connection discontinued")
-			// 	return
-			// }
-
-			if errors.Is(err, net.ErrClosed) {
-				fmt.Println("Peer connection discontinued")
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
 				return
 			}
-			fmt.Printf("TCP error %v\n", err)
+			t.decodeErrors.Add(1)
+			log.Error("decoding message", "err", err)
 			continue
 		}
 
 		rpc.From = conn.RemoteAddr().String()
 
 		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+			log.Debug("incoming stream, waiting for it to be read")
+			peer.streaming.Store(true)
+			// Nobody is left to close the stream once the transport is
+			// closed.
+			select {
+			case <-peer.stream:
+			case <-t.closed:
+				err = net.ErrClosed
+				return
+			}
+			peer.streaming.Store(false)
+			log.Debug("stream closed, resuming read loop")
 			continue
 		}
 		// wait for other peers (go routines) to read from the connection
 		// before proceeding to a next read cycle
-		t.rpcch <- rpc
+		select {
+		case t.rpcch <- rpc:
+		case <-t.closed:
+			err = net.ErrClosed
+			return
+		}
 	}
 }
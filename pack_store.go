@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultPackRootFolderName = "rivulet_packs"
+	defaultSegmentSize        = 256 << 20
+	segmentFileExt            = ".pack"
+)
+
+type PackStoreOpts struct {
+	// Root is the folder holding the segment files and their index.
+	Root string
+	// SegmentSize is the size after which a segment is sealed and a new one is
+	// started.
+	SegmentSize int64
+	// Logger is what the store logs to, nothing when left nil.
+	Logger *slog.Logger
+}
+
+// PackStore appends objects one after the other into large segment files
+// instead of giving each object its own file, and keeps their offsets in a
+// key index. It suits millions of small objects that would otherwise cost one
+// file and a handful of directories each.
+type PackStore struct {
+	PackStoreOpts
+
+	// mu serialises appends to the active segment and guards the fields
+	// below.
+	mu         sync.Mutex
+	index      *keyIndex
+	active     *os.File
+	activeSize int64
+
+	// segLock keeps compaction from removing a segment while a reader is
+	// opening it.
+	segLock sync.RWMutex
+}
+
+func NewPackStore(opts PackStoreOpts) *PackStore {
+	if len(opts.Root) == 0 {
+		opts.Root = defaultPackRootFolderName
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = discardLogger()
+	}
+
+	return &PackStore{
+		PackStoreOpts: opts,
+	}
+}
+
+// open loads the index and the active segment the first time the store is
+// used. It must be called with s.mu held.
+func (s *PackStore) open() error {
+	if s.index != nil {
+		return nil
+	}
+
+	idx, err := openIndex(s.Root)
+	if err != nil {
+		return fmt.Errorf("opening key index: %w", err)
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		idx.close()
+		return err
+	}
+
+	name := segmentName(1)
+	if len(segments) > 0 {
+		name = segments[len(segments)-1]
+	}
+	if err := s.openSegment(name); err != nil {
+		idx.close()
+		return err
+	}
+
+	s.index = idx
+	return nil
+}
+
+func (s *PackStore) keys() (*keyIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s.index, nil
+}
+
+// segments returns the names of the segment files on disk, oldest first.
+func (s *PackStore) segments() ([]string, error) {
+	files, err := os.ReadDir(s.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), segmentFileExt) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func segmentName(n int) string {
+	return fmt.Sprintf("%08d%s", n, segmentFileExt)
+}
+
+func (s *PackStore) openSegment(name string) error {
+	f, err := os.OpenFile(filepath.Join(s.Root, name), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if s.active != nil {
+		s.active.Close()
+	}
+	s.active = f
+	s.activeSize = fi.Size()
+	return nil
+}
+
+// roll seals the active segment and starts the next one.
+func (s *PackStore) roll() error {
+	var n int
+	if _, err := fmt.Sscanf(filepath.Base(s.active.Name()), "%08d"+segmentFileExt, &n); err != nil {
+		return err
+	}
+	return s.openSegment(segmentName(n + 1))
+}
+
+func (s *PackStore) Has(id string, key string) bool {
+	idx, err := s.keys()
+	if err != nil {
+		s.Logger.Error("loading pack index", "root", s.Root, "err", err)
+		return false
+	}
+
+	_, ok := idx.get(id, key)
+	return ok
+}
+
+func (s *PackStore) Read(id string, key string) (int64, io.Reader, error) {
+	idx, err := s.keys()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	e, ok := idx.get(id, key)
+	if !ok {
+		return 0, nil, fmt.Errorf("read %s: %w", key, os.ErrNotExist)
+	}
+
+	s.segLock.RLock()
+	f, err := os.Open(filepath.Join(s.Root, e.Path))
+	s.segLock.RUnlock()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return e.Meta.Size, &sectionReadCloser{
+		SectionReader: io.NewSectionReader(f, e.Offset, e.Meta.Size),
+		Closer:        f,
+	}, nil
+}
+
+// sectionReadCloser closes the segment file once the object has been read.
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func (s *PackStore) Write(id string, key string, r io.Reader) (int64, error) {
+	return s.WriteWithMeta(id, key, Metadata{}, r)
+}
+
+func (s *PackStore) WriteWithMeta(id string, key string, meta Metadata, r io.Reader) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+
+	mw := newMetaWriter()
+	e, n, err := s.append(io.TeeReader(r, mw))
+	if err != nil {
+		return n, err
+	}
+
+	meta.Key = key
+	meta.Owner = id
+	mw.fill(&meta)
+
+	e.Meta = meta
+	return n, s.index.put(id, key, e)
+}
+
+// append copies r at the end of the active segment, starting a new one first
+// if it is full. It must be called with s.mu held.
+func (s *PackStore) append(r io.Reader) (indexEntry, int64, error) {
+	if s.activeSize >= s.SegmentSize {
+		if err := s.roll(); err != nil {
+			return indexEntry{}, 0, err
+		}
+	}
+
+	offset := s.activeSize
+	n, err := io.Copy(s.active, r)
+	// Whatever made it into the segment is there to stay, even if the copy
+	// failed half way. It just becomes dead space.
+	s.activeSize += n
+
+	return indexEntry{
+		Path:   filepath.Base(s.active.Name()),
+		Offset: offset,
+	}, n, err
+}
+
+// Delete forgets about the object. The bytes it took in its segment are only
+// reclaimed when the segment is compacted.
+func (s *PackStore) Delete(id string, key string) error {
+	// Holding mu keeps a running compaction from moving the object back to
+	// life right after we deleted it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if _, ok := s.index.get(id, key); !ok {
+		return nil
+	}
+	return s.index.del(id, key)
+}
+
+// compactRatio is the share of a segment that must be dead before Compact
+// bothers rewriting it.
+const compactRatio = 0.5
+
+// Compact reclaims the space held by deleted and overwritten objects. Every
+// sealed segment that is mostly dead has its live objects moved to the active
+// segment and is then removed. It returns the number of bytes reclaimed.
+func (s *PackStore) Compact() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+
+	var (
+		live    = make(map[string][]packedObject)
+		liveLen = make(map[string]int64)
+	)
+	s.index.each(func(id string, key string, e indexEntry) {
+		live[e.Path] = append(live[e.Path], packedObject{id, key, e})
+		liveLen[e.Path] += e.Meta.Size
+	})
+
+	segments, err := s.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	for _, name := range segments {
+		if name == filepath.Base(s.active.Name()) {
+			continue
+		}
+
+		fi, err := os.Stat(filepath.Join(s.Root, name))
+		if err != nil {
+			return reclaimed, err
+		}
+		if float64(liveLen[name]) > float64(fi.Size())*(1-compactRatio) {
+			continue
+		}
+
+		if err := s.moveObjects(name, live[name]); err != nil {
+			return reclaimed, err
+		}
+
+		s.segLock.Lock()
+		err = os.Remove(filepath.Join(s.Root, name))
+		s.segLock.Unlock()
+		if err != nil {
+			return reclaimed, err
+		}
+
+		reclaimed += fi.Size() - liveLen[name]
+	}
+
+	return reclaimed, nil
+}
+
+type packedObject struct {
+	id  string
+	key string
+	e   indexEntry
+}
+
+// moveObjects copies the given objects out of segment into the active one and
+// points the index at their new location.
+func (s *PackStore) moveObjects(segment string, objects []packedObject) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(s.Root, segment))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, o := range objects {
+		e, _, err := s.append(io.NewSectionReader(f, o.e.Offset, o.e.Meta.Size))
+		if err != nil {
+			return err
+		}
+		e.Meta = o.e.Meta
+
+		if err := s.index.put(o.id, o.key, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PackStore) List(id string, opts ListOpts) (ListResult, error) {
+	idx, err := s.keys()
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	return paginate(idx.list(id), opts), nil
+}
+
+func (s *PackStore) Owners() ([]string, error) {
+	idx, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := idx.owners()
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *PackStore) Stat(id string, key string) (Metadata, error) {
+	idx, err := s.keys()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	e, ok := idx.get(id, key)
+	if !ok {
+		return Metadata{}, fmt.Errorf("stat %s: %w", key, os.ErrNotExist)
+	}
+	return e.Meta, nil
+}
+
+func (s *PackStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.index != nil {
+		s.index.close()
+		s.active.Close()
+		s.index, s.active, s.activeSize = nil, nil, 0
+	}
+
+	return os.RemoveAll(s.Root)
+}
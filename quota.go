@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const usageFileName = "usage.json"
+
+var errOverQuota = errors.New("over quota")
+
+// usageLedger keeps count of the bytes a node holds on behalf of every owner
+// other than itself, so quotas can be checked before a stream is accepted
+// rather than once the disk is full.
+//
+// The same bytes are counted by the host of the peer they came from as well.
+// Owner IDs are whatever peers say they are, so a peer could get around the
+// quota of an owner by making up new ones, but not around its own.
+type usageLedger struct {
+	mu sync.Mutex
+	// path is empty for ledgers that only live in memory.
+	path   string
+	owners map[string]int64
+	peers  map[string]int64
+	total  int64
+}
+
+// usageFile is what the ledger looks like on disk. Ledgers written before
+// peers were counted are a bare map of owners.
+type usageFile struct {
+	Owners map[string]int64
+	Peers  map[string]int64
+}
+
+// openUsageLedger loads the ledger kept under root, or starts an empty one.
+// With an empty root the ledger is never written anywhere.
+func openUsageLedger(root string) (*usageLedger, error) {
+	l := &usageLedger{
+		owners: make(map[string]int64),
+		peers:  make(map[string]int64),
+	}
+	if root == "" {
+		return l, nil
+	}
+	l.path = filepath.Join(root, usageFileName)
+
+	b, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f usageFile
+	if err := json.Unmarshal(b, &f); err == nil && f.Owners != nil {
+		l.owners = f.Owners
+		if f.Peers != nil {
+			l.peers = f.Peers
+		}
+	} else if err := json.Unmarshal(b, &l.owners); err != nil {
+		return nil, fmt.Errorf("usage ledger: %w", err)
+	}
+	for _, n := range l.owners {
+		l.total += n
+	}
+
+	return l, nil
+}
+
+// snapshot returns the bytes held per owner.
+func (l *usageLedger) snapshot() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make(map[string]int64, len(l.owners))
+	for owner, n := range l.owners {
+		out[owner] = n
+	}
+	return out
+}
+
+// check reports whether owner may grow by delta bytes, and the peer host
+// sending them by peerDelta, without going over ownerQuota and peerQuota
+// respectively or the node going over globalQuota, a zero quota meaning no
+// cap.
+func (l *usageLedger) check(owner string, peer string, delta int64, peerDelta int64, ownerQuota int64, peerQuota int64, globalQuota int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ownerQuota > 0 && l.owners[owner]+delta > ownerQuota {
+		return fmt.Errorf("%w: owner %s holds %d of %d bytes", errOverQuota, owner, l.owners[owner], ownerQuota)
+	}
+	if peerQuota > 0 && l.peers[peer]+peerDelta > peerQuota {
+		return fmt.Errorf("%w: peer %s holds %d of %d bytes", errOverQuota, peer, l.peers[peer], peerQuota)
+	}
+	if globalQuota > 0 && l.total+delta > globalQuota {
+		return fmt.Errorf("%w: node holds %d of %d bytes", errOverQuota, l.total, globalQuota)
+	}
+	return nil
+}
+
+// add accounts delta more bytes, which may be negative, to owner and the
+// peer host they came from, and persists the ledger.
+func (l *usageLedger) add(owner string, peer string, delta int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.owners[owner] += delta
+	l.total += delta
+	if l.owners[owner] <= 0 {
+		l.total -= l.owners[owner]
+		delete(l.owners, owner)
+	}
+
+	l.peers[peer] += delta
+	if l.peers[peer] <= 0 {
+		delete(l.peers, peer)
+	}
+
+	return l.save()
+}
+
+// save atomically replaces the ledger on disk. It must be called with l.mu
+// held.
+func (l *usageLedger) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(usageFile{Owners: l.owners, Peers: l.peers}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
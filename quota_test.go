@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestUsageLedger(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := openUsageLedger(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.add("alice", "10.0.0.1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.add("bob", "10.0.0.2", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.check("alice", "10.0.0.1", 50, 50, 100, 100, 0); !errors.Is(err, errOverQuota) {
+		t.Errorf("owner quota: have %v want %v", err, errOverQuota)
+	}
+	if err := l.check("carol", "10.0.0.3", 20, 20, 100, 100, 100); !errors.Is(err, errOverQuota) {
+		t.Errorf("global quota: have %v want %v", err, errOverQuota)
+	}
+	if err := l.check("alice", "10.0.0.1", 10, 10, 100, 100, 100); err != nil {
+		t.Errorf("within quota: %v", err)
+	}
+	// Making up a new owner ID doesn't get a peer around its quota.
+	if err := l.check("mallory", "10.0.0.1", 50, 50, 100, 100, 0); !errors.Is(err, errOverQuota) {
+		t.Errorf("peer quota: have %v want %v", err, errOverQuota)
+	}
+	// Nor does claiming an owner without a cap.
+	if err := l.check("mallory", "10.0.0.1", 50, 50, 0, 100, 0); !errors.Is(err, errOverQuota) {
+		t.Errorf("peer quota of an uncapped owner: have %v want %v", err, errOverQuota)
+	}
+
+	// Accounting survives a restart.
+	if err := l.add("alice", "10.0.0.1", -60); err != nil {
+		t.Fatal(err)
+	}
+	l, err = openUsageLedger(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := l.snapshot()
+	if len(usage) != 1 || usage["bob"] != 30 || l.total != 30 {
+		t.Errorf("have %v (total %d) want map[bob:30]", usage, l.total)
+	}
+	if len(l.peers) != 1 || l.peers["10.0.0.2"] != 30 {
+		t.Errorf("peers: have %v want map[10.0.0.2:30]", l.peers)
+	}
+
+	// So do ledgers written before peers were counted.
+	if err := os.WriteFile(filepath.Join(root, usageFileName), []byte(`{"bob": 30}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err = openUsageLedger(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := l.snapshot(); len(usage) != 1 || usage["bob"] != 30 {
+		t.Errorf("old ledger: have %v want map[bob:30]", usage)
+	}
+}
+
+func TestQuotaRejectsStore(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	a.OwnerQuota = 1000
+	// Claiming an owner without a cap doesn't get a host around its own.
+	a.OwnerQuotas = map[string]int64{"uncapped": 0}
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	c := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	c.ID = "uncapped"
+	cErr := make(chan error, 1)
+	go func() { cErr <- c.Start() }()
+	waitFor(t, "b and c to connect", func() bool {
+		return len(a.Peers()) == 2
+	})
+
+	data := strings.Repeat("x", 600)
+	if err := b.Store("first", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Store("second", strings.NewReader(data)); !errors.Is(err, errStoreRejected) {
+		t.Errorf("over quota: have %v want %v", err, errStoreRejected)
+	}
+	if res, _ := a.store.List(b.ID, ListOpts{}); len(res.Entries) != 1 {
+		t.Errorf("a holds %d objects of b want 1", len(res.Entries))
+	}
+
+	// Coming back under another owner ID from the same host doesn't get
+	// around the quota either.
+	if err := c.Store("third", strings.NewReader(data)); !errors.Is(err, errStoreRejected) {
+		t.Errorf("other owner from the same host: have %v want %v", err, errStoreRejected)
+	}
+
+	c.Stop()
+	b.Stop()
+	a.Stop()
+	for _, errc := range []chan error{aErr, bErr, cErr} {
+		if err := <-errc; err != nil {
+			t.Errorf("start returned %v", err)
+		}
+	}
+}
+
+// failingStore fails every write of the objects of owner half way through
+// once fail is set, the way a transfer cut short does.
+type failingStore struct {
+	Storage
+	owner string
+	fail  atomic.Bool
+}
+
+var errWriteCut = errors.New("write cut short")
+
+func (s *failingStore) WriteWithMeta(id string, key string, meta Metadata, r io.Reader) (int64, error) {
+	if id == s.owner && s.fail.Load() {
+		r = io.MultiReader(io.LimitReader(r, 4), iotest.ErrReader(errWriteCut))
+	}
+	return s.Storage.WriteWithMeta(id, key, meta, r)
+}
+
+func TestFailedReplaceKeepsReplica(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	store := &failingStore{
+		Storage: NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}),
+		owner:   b.ID,
+	}
+	a.store = store
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	if err := b.Store("notes.txt", strings.NewReader("first draft")); err != nil {
+		t.Fatal(err)
+	}
+	wire := b.wireKey("notes.txt")
+	held, err := a.store.Stat(b.ID, wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := a.store.Read(b.ID, wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, _ := io.ReadAll(r)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	usage, _ := a.Usage()
+
+	// The same replica sent again, and a newer version of it, both cut
+	// short on their way to the disk of a.
+	store.fail.Store(true)
+	if err := b.push(TraceContext{}, b.ID, wire, held, replica); !errors.Is(err, errStoreRejected) {
+		t.Errorf("same replica: have %v want %v", err, errStoreRejected)
+	}
+	if err := b.Store("notes.txt", strings.NewReader("second draft")); !errors.Is(err, errStoreRejected) {
+		t.Errorf("newer version: have %v want %v", err, errStoreRejected)
+	}
+
+	// a still holds the replica it had, charged as it was.
+	_, r, err = a.store.Read(b.ID, wire)
+	if err != nil {
+		t.Fatalf("replica lost: %v", err)
+	}
+	have, _ := io.ReadAll(r)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	if !bytes.Equal(have, replica) {
+		t.Errorf("replica changed after failed writes")
+	}
+	if after, _ := a.Usage(); after[b.ID] != usage[b.ID] {
+		t.Errorf("usage: have %d want %d", after[b.ID], usage[b.ID])
+	}
+	if res, _ := a.store.List(versionsID(b.ID), ListOpts{}); len(res.Entries) != 0 {
+		t.Errorf("failed write left %d versions behind", len(res.Entries))
+	}
+
+	b.Stop()
+	a.Stop()
+	<-aErr
+	<-bErr
+}
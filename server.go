@@ -1,206 +1,1410 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kurocifer/rivulet/p2p"
 )
 
 type FileServerOPts struct {
+	// ID is the owner ID of this node. Every object the node stores on behalf
+	// of itself (and on peers) is namespaced under it.
+	ID string
+	// NodeID tells this node apart from other nodes running under the same
+	// owner ID, in the vector clocks of the versions it writes. A fresh one
+	// is generated when it is left empty.
+	NodeID            string
 	StoreageRoot      string
 	PathTransformFunc PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string
+	// Keystore holds the keys encrypting the copies of our objects we hand
+	// out to peers. When nil, an in-memory keystore holding only EncKey is
+	// used, and those copies can't be read back after a restart.
+	Keystore *Keystore
+	// EncKey is the key of the in-memory keystore. A fresh key is generated
+	// when it is left empty.
+	EncKey []byte
+	// Convergent turns on convergent encryption: the content of an object is
+	// encrypted under a key derived from the plaintext itself, so identical
+	// files stored by different owners end up as the same blob on our peers
+	// and are only kept once. Only the small reference to the blob is
+	// encrypted under our own keys.
+	Convergent bool
+	// DataShards turns on erasure coding when set: instead of a full copy,
+	// every peer is handed shards of our objects, any DataShards of which are
+	// enough to get an object back. ParityShards is how many of them may be
+	// lost. Nodes reading erasure coded objects, capabilities included, need
+	// it set too.
+	DataShards   int
+	ParityShards int
+	// OwnerQuota caps the bytes this node holds on behalf of any single other
+	// owner, and OwnerQuotas overrides it for the owners it lists. Owner IDs
+	// are taken on the word of the peers sending the objects, so PeerQuota
+	// caps all a peer host has us hold, under whatever owner IDs, and falls
+	// back to OwnerQuota when zero.
+	// GlobalQuota caps the bytes held on behalf of all of them together. Zero
+	// means no cap. What is held is accounted under StoreageRoot, so it
+	// survives restarts.
+	OwnerQuota  int64
+	OwnerQuotas map[string]int64
+	PeerQuota   int64
+	GlobalQuota int64
+	// OwnerKeys pins the signing key of every other owner whose capabilities
+	// this node honours, by owner ID. The key an owner signs with is part of
+	// its Status.
+	OwnerKeys map[string]ed25519.PublicKey
+	// VersionPolicy tells how many superseded versions of every key held are
+	// kept around. By default they all are.
+	VersionPolicy VersionPolicy
+	// Resolver settles versions of a key written concurrently, by nodes
+	// sharing an owner ID. LastWriterWins is used when it is nil.
+	Resolver ConflictResolver
+	// SweepInterval is how often expired objects are swept away and the
+	// store compacted, once a minute when left zero.
+	SweepInterval time.Duration
+	// Storage is where the server keeps its objects. When nil, a disk Store
+	// is built from StoreageRoot and PathTransformFunc.
+	Storage        Storage
+	Transport      p2p.Transport
+	BootstrapNodes []string
+	// Logger is what the server logs to, nothing when left nil.
+	Logger *slog.Logger
+	// Tracer is what the server emits spans to, around the phases of its
+	// operations and of the messages of peers it handles. Nothing is traced
+	// when it is nil.
+	Tracer Tracer
+}
+
+// discardLogger is the logger of whatever is given none.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
 }
 
 type FileServer struct {
 	FileServerOPts
 
-	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
+	peerLock sync.Mutex
+	peers    map[string]p2p.Peer
+	// streams counts the streams being sent to every peer.
+	streams map[string]int
+
+	store Storage
+	keys  *Keystore
+	quit  chan struct{}
+
+	// streamLock keeps two streams from being interleaved on the same peer
+	// connections.
+	streamLock sync.Mutex
+
+	listLock sync.Mutex
+	lists    map[string]chan ListResult
+
+	// writeLock keeps the writes of our own keys, by Store and by adopting
+	// those of our other nodes, from interleaving.
+	writeLock sync.Mutex
+
+	// stores holds the pushes waiting on peers to answer, by request ID.
+	storeLock sync.Mutex
+	stores    map[string]chan storeAnswer
+
+	usageLock sync.Mutex
+	usage     *usageLedger
+
+	metrics *serverMetrics
+
+	// stopping is closed once Stop is called. From then on no operation is
+	// started, and Stop waits for those in ops, inflight of them, and the
+	// goroutines in wg.
+	stopLock sync.Mutex
+	stopping chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+	ops      sync.WaitGroup
+	inflight atomic.Int64
+	wg       sync.WaitGroup
+
+	// started is when Start was called.
+	started time.Time
+}
+
+// errServerStopped is returned by the operations of a stopped server.
+var errServerStopped = errors.New("file server stopped")
+
+// errStoreRejected is returned when a peer refuses to store an object we push
+// to it, such as when it would put us over our quota.
+var errStoreRejected = errors.New("peer refused to store the object")
+
+// errTruncatedTransfer is returned when a peer goes away in the middle of
+// sending us an object.
+var errTruncatedTransfer = errors.New("peer connection ended in the middle of a transfer")
+
+// stopTimeout is how long Stop waits for operations in flight before cutting
+// them short.
+const stopTimeout = time.Second * 30
+
+func NewFileServer(opts FileServerOPts) *FileServer {
+	if len(opts.ID) == 0 {
+		opts.ID = generateID()
+	}
+	if len(opts.NodeID) == 0 {
+		opts.NodeID = generateID()[:16]
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = LastWriterWins
+	}
+	if opts.Keystore == nil {
+		if len(opts.EncKey) == 0 {
+			opts.EncKey = newEncryptionKey()
+		}
+		opts.Keystore = newMemoryKeystore(opts.EncKey)
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = discardLogger()
+	}
+	if opts.Transport != nil {
+		opts.Logger = opts.Logger.With("node", opts.Transport.Addr())
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = noopTracer{}
+	}
+
+	if opts.Storage == nil {
+		storeOpts := StoreOpts{
+			Root:              opts.StoreageRoot,
+			PathTransformFunc: opts.PathTransformFunc,
+			Logger:            opts.Logger,
+		}
+		opts.Storage = NewStore(storeOpts)
+	}
+
+	return &FileServer{
+		FileServerOPts: opts,
+		store:          opts.Storage,
+		keys:           opts.Keystore,
+		quit:           make(chan struct{}),
+		stopping:       make(chan struct{}),
+		metrics:        newServerMetrics(),
+		peers:          make(map[string]p2p.Peer),
+		streams:        make(map[string]int),
+		lists:          make(map[string]chan ListResult),
+		stores:         make(map[string]chan storeAnswer),
+	}
+}
+
+type Message struct {
+	// Trace is the span the message was sent under, if any. The handling of
+	// the message is traced as a child of it.
+	Trace   TraceContext
+	Payload any
+}
+
+type MessageStoreFile struct {
+	// RequestID is echoed back in the MessageStored or MessageStoreRejected
+	// answering the message.
+	RequestID string
+	ID        string
+	Key       string
+	Size      int64
+	Meta      Metadata
+}
+
+// MessageStored tells the sender of a MessageStoreFile that its object was
+// stored.
+type MessageStored struct {
+	RequestID string
+}
+
+// MessageStoreRejected tells the sender of a MessageStoreFile that its object
+// was not stored, and why.
+type MessageStoreRejected struct {
+	RequestID string
+	ID        string
+	Key       string
+	Reason    string
+}
+
+type MessageDeleteFile struct {
+	ID  string
+	Key string
+}
+
+// MessageGoodbye tells peers we are going away and they should drop us.
+type MessageGoodbye struct{}
+
+type MessageGetFile struct {
+	ID  string
+	Key string
+}
+
+type MessageListFiles struct {
+	RequestID string
+	ID        string
+	Opts      ListOpts
+}
+
+type MessageListFilesResult struct {
+	RequestID string
+	Result    ListResult
+}
+
+// storeTimeout is how long a push waits for peers to tell whether they stored
+// what they were sent.
+const storeTimeout = time.Second * 30
+
+// listTimeout is how long List waits for peers to answer.
+const listTimeout = time.Second * 2
+
+// broadcast delivers msg to every peer we are connected to.
+func (s *FileServer) broadcast(msg *Message) error {
+	_, err := s.broadcastTo(s.connectedPeers(), msg)
+	return err
+}
+
+// broadcastTo delivers msg to peers, a snapshot of them taken with
+// connectedPeers, and returns those it reached. Operations expecting an answer
+// only wait on those. A peer going away doesn't keep the others from getting
+// msg, the errors of the peers that could not be reached are returned along.
+func (s *FileServer) broadcastTo(peers []p2p.Peer, msg *Message) ([]p2p.Peer, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	var (
+		reached = make([]p2p.Peer, 0, len(peers))
+		errs    []error
+	)
+	for _, peer := range peers {
+		if err := peer.Send(p2p.EncodeMessage(buf.Bytes())); err != nil {
+			errs = append(errs, fmt.Errorf("sending to (%s): %w", peer.RemoteAddr(), err))
+			continue
+		}
+		reached = append(reached, peer)
+	}
+
+	return reached, errors.Join(errs...)
+}
+
+// send delivers msg to a single peer.
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return peer.Send(p2p.EncodeMessage(buf.Bytes()))
+}
+
+// Get returns one of our objects, fetching it from the network if we don't
+// hold it. key may also be a capability token, see Share, for an object of
+// someone else.
+func (s *FileServer) Get(key string) (io.Reader, error) {
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
+
+	span := s.Tracer.Start(TraceContext{}, "Get")
+	// Capability tokens are as good as the object, they are left out.
+	if !isCapability(key) {
+		span.SetAttrs("key", key)
+	}
+	start := time.Now()
+	r, err := s.get(span.Context(), key)
+	s.metrics.observe("get", start, err)
+	span.End(err)
+	return r, err
+}
+
+func (s *FileServer) get(tc TraceContext, key string) (io.Reader, error) {
+	if isCapability(key) {
+		return s.getShared(tc, key)
+	}
+
+	// Replicas expire along with our own copy, there is no point asking.
+	if meta, err := s.store.Stat(s.ID, key); err == nil && meta.expired(time.Now()) {
+		return nil, fmt.Errorf("get %s: %w", key, os.ErrNotExist)
+	}
+
+	if s.has(s.ID, key) {
+		s.Logger.Debug("serving object from local disk", "key", key)
+
+		_, r, err := s.store.Read(s.ID, key)
+		return r, err
+	}
+
+	s.Logger.Debug("object not held locally, fetching it from the network", "key", key)
+
+	if err := s.fetchInto(tc, key, s.wireKey(key), s.ID, key, Metadata{}); err != nil {
+		return nil, err
+	}
+
+	_, r, err := s.store.Read(s.ID, key)
+	return r, err
+}
+
+// fetchInto fetches our object key, which peers hold as src, from the network
+// and decrypts it into (id, dst) of our store, with meta as in WriteWithMeta.
+func (s *FileServer) fetchInto(tc TraceContext, key string, src string, id string, dst string, meta Metadata) error {
+	var ref *convergentRef
+	err := s.retrieve(tc, s.ID, src, func(r io.Reader) (int64, error) {
+		n, found, err := s.receive(key, id, dst, meta, r)
+		if found != nil {
+			ref = found
+		}
+		return n, err
+	})
+	if err != nil || ref == nil {
+		return err
+	}
+
+	// What came back only points at the shared blob holding the content.
+	return s.retrieve(tc, convergentID, ref.Blob, func(r io.Reader) (int64, error) {
+		return writeDecrypt(s.store, newMemoryKeystore(ref.Key).Key, id, dst, meta, r)
+	})
+}
+
+// wireKey is the name our own key goes by outside of this node. Peers only
+// ever get to see it, never the key itself.
+func (s *FileServer) wireKey(key string) string {
+	return hashKey(s.keys.NameKey(), key)
+}
+
+// objectKeys looks up the key one of our replicas, held by peers as wire, was
+// sealed with. Replicas are sealed under a key derived for them alone, see
+// objectKey, except for those handed out before that, which were sealed under
+// a key of the keystore directly.
+func (s *FileServer) objectKeys(wire string) keyLookup {
+	return func(id string) ([]byte, error) {
+		for _, ksID := range s.keys.IDs() {
+			key, err := s.keys.Key(ksID)
+			if err != nil {
+				continue
+			}
+			if ok := objectKey(key, wire); keyID(ok) == id {
+				return ok, nil
+			}
+		}
+		return s.keys.Key(id)
+	}
+}
+
+// fetch asks every peer for the object (id, key) and hands the streams of the
+// peers holding it to handle.
+func (s *FileServer) fetch(tc TraceContext, id string, key string, handle func(io.Reader) (int64, error)) error {
+	return s.ask(tc, id, key, MessageGetFile{ID: id, Key: key}, handle)
+}
+
+// ask broadcasts the request payload for (id, key) and hands the answer of
+// every peer that holds something of it to handle.
+func (s *FileServer) ask(tc TraceContext, id string, key string, payload any, handle func(io.Reader) (int64, error)) (err error) {
+	span := s.Tracer.Start(tc, "fetch")
+	span.SetAttrs("owner", id, "key", key)
+	defer func() { span.End(err) }()
+
+	msg := Message{
+		Trace:   span.Context(),
+		Payload: payload,
+	}
+
+	bspan := s.Tracer.Start(span.Context(), "broadcast")
+	peers, err := s.broadcastTo(s.connectedPeers(), &msg)
+	bspan.End(err)
+	if err != nil {
+		// The peers that did get the request still answer it.
+		s.Logger.Warn("asking peers for object", "owner", id, "key", key, "err", err)
+	}
+
+	wspan := s.Tracer.Start(span.Context(), "wait for peers")
+	time.Sleep(time.Millisecond * 500)
+	wspan.End(nil)
+
+	for _, peer := range peers {
+		if err := s.receiveFrom(span.Context(), peer, id, key, handle); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receiveFrom reads the answer of peer to a MessageGetFile for (id, key),
+// handing the stream to handle if the peer holds the object.
+func (s *FileServer) receiveFrom(tc TraceContext, peer p2p.Peer, id string, key string, handle func(io.Reader) (int64, error)) (err error) {
+	start := time.Now()
+
+	span := s.Tracer.Start(tc, "receive")
+	span.SetAttrs("peer", peer.RemoteAddr().String())
+	defer func() { span.End(err) }()
+
+	// The time spent reading off the connection, as opposed to handling what
+	// was read.
+	tr := &timedReader{r: peer}
+
+	// First read the file size so we can limit the amout of bytes that we read
+	// from the connection to the file szie, so we don't keep it hanging.
+	var fileSize int64
+	if err := binary.Read(tr, binary.LittleEndian, &fileSize); err != nil {
+		peer.CloseStream()
+		return fmt.Errorf("[%s] fetching (%s) from (%s): %w", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+	}
+	if fileSize < 0 {
+		// The peer doesn't have it.
+		span.SetAttrs("found", false)
+		peer.CloseStream()
+		return nil
+	}
+
+	lr := newStreamReader(tr, fileSize)
+	n, err := handle(lr)
+	span.SetAttrs("found", true, "bytes", n, "network_wait", tr.wait)
+	if err != nil {
+		// Whatever is left of the stream still has to come off the
+		// connection before it can be handed back to the transport.
+		io.Copy(io.Discard, lr)
+		peer.CloseStream()
+		return fmt.Errorf("[%s] fetching (%s) from (%s): %w", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+	}
+	s.Logger.Info("received object", "peer", peer.RemoteAddr().String(), "owner", id, "key", key, "bytes", n, "duration", time.Since(start))
+
+	peer.CloseStream()
+	return nil
+}
+
+// retrieve is fetch, falling back to gathering the shards of the object when
+// no peer holds a full copy of it and we run in erasure coding mode.
+func (s *FileServer) retrieve(tc TraceContext, id string, key string, handle func(io.Reader) (int64, error)) error {
+	var found bool
+	err := s.fetch(tc, id, key, func(r io.Reader) (int64, error) {
+		found = true
+		return handle(r)
+	})
+	if err != nil || found || s.DataShards == 0 {
+		return err
+	}
+
+	data, ok, err := s.fetchShards(tc, id, key)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = handle(bytes.NewReader(data))
+	return err
+}
+
+// receive decrypts our object key fetched from the network into (id, dst) of
+// the store. When it turns out to be a reference to a convergent blob, the
+// reference is returned instead and nothing is stored.
+func (s *FileServer) receive(key string, id string, dst string, meta Metadata, r io.Reader) (int64, *convergentRef, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := copyDecryptWith(s.objectKeys(s.wireKey(key)), r, pw)
+		pw.CloseWithError(err)
+	}()
+	// Unblock the decrypting goroutine if we stop reading early.
+	defer pr.Close()
+
+	br := bufio.NewReader(pr)
+	if isConvergentRef(br) {
+		ref, err := readConvergentRef(br)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Make sure the whole stream checked out before trusting it.
+		if _, err := io.Copy(io.Discard, br); err != nil {
+			return 0, nil, err
+		}
+		return 0, ref, nil
+	}
+
+	n, err := s.store.WriteWithMeta(id, dst, meta, br)
+	return n, nil, err
+}
+
+// Stat returns the metadata this node holds for one of its own keys.
+func (s *FileServer) Stat(key string) (Metadata, error) {
+	if err := s.begin(); err != nil {
+		return Metadata{}, err
+	}
+	defer s.end()
+
+	return s.store.Stat(s.ID, key)
+}
+
+// List returns the keys held for the owner id across this node and all of its
+// peers, merged and paged according to opts.
+//
+// Peers hold our own objects under hashed names they can't page through in
+// order, so for our own ID, and the namespace of our superseded versions,
+// every peer is asked for everything it holds and the names are recovered and
+// paged here.
+func (s *FileServer) List(id string, opts ListOpts) (ListResult, error) {
+	if err := s.begin(); err != nil {
+		return ListResult{}, err
+	}
+	defer s.end()
+
+	span := s.Tracer.Start(TraceContext{}, "List")
+	span.SetAttrs("owner", id)
+	start := time.Now()
+	res, err := s.list(span.Context(), id, opts)
+	s.metrics.observe("list", start, err)
+	span.End(err)
+	return res, err
+}
+
+func (s *FileServer) list(tc TraceContext, id string, opts ListOpts) (ListResult, error) {
+	local, err := s.store.List(id, opts)
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	own := ownerOf(id) == s.ID
+
+	peerOpts := opts
+	if own {
+		peerOpts = ListOpts{}
+	}
+
+	peers := s.connectedPeers()
+	if len(peers) == 0 {
+		return local, nil
+	}
+
+	reqID := generateID()
+	results := make(chan ListResult, len(peers))
+
+	s.listLock.Lock()
+	s.lists[reqID] = results
+	s.listLock.Unlock()
+
+	defer func() {
+		s.listLock.Lock()
+		delete(s.lists, reqID)
+		s.listLock.Unlock()
+	}()
+
+	msg := Message{
+		Trace: tc,
+		Payload: MessageListFiles{
+			RequestID: reqID,
+			ID:        id,
+			Opts:      peerOpts,
+		},
+	}
+
+	peers, err = s.broadcastTo(peers, &msg)
+	if err != nil {
+		s.Logger.Warn("asking peers for their list", "owner", id, "err", err)
+	}
+	expected := len(peers)
+
+	var (
+		timeout = time.After(listTimeout)
+		merged  = map[string]Metadata{}
+		more    = local.Next != ""
+	)
+
+	for _, meta := range local.Entries {
+		merged[meta.Key] = meta
+	}
+
+	wspan := s.Tracer.Start(tc, "wait for peers")
+	wspan.SetAttrs("peers", expected)
+
+collect:
+	for i := 0; i < expected; i++ {
+		select {
+		case res := <-results:
+			more = more || res.Next != ""
+			for _, meta := range res.Entries {
+				if own {
+					if meta, err = s.unsealMeta(meta); err != nil {
+						s.Logger.Warn("list: dropping entry", "key", meta.Key, "err", err)
+						continue
+					}
+				}
+				if have, ok := merged[meta.Key]; !ok || newer(meta, have) {
+					merged[meta.Key] = meta
+				}
+			}
+		case <-timeout:
+			s.Logger.Warn("list timed out waiting on peers", "peers", expected-i, "duration", listTimeout)
+			wspan.SetAttrs("timed_out", expected-i)
+			break collect
+		}
+	}
+	wspan.End(nil)
+
+	entries := make([]Metadata, 0, len(merged))
+	for _, meta := range merged {
+		entries = append(entries, meta)
+	}
+
+	res := paginate(entries, opts)
+	// A peer may have stopped early at its own limit, so the merged page is not
+	// necessarily the last one even if it fits.
+	if more && res.Next == "" && len(res.Entries) > 0 {
+		res.Next = res.Entries[len(res.Entries)-1].Key
+	}
+
+	return res, nil
+}
+
+// newer reports whether a is a newer version of an object than b.
+func newer(a Metadata, b Metadata) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.Created.After(b.Created)
+}
+
+// unsealMeta recovers the real name behind the metadata of one of our replicas.
+func (s *FileServer) unsealMeta(meta Metadata) (Metadata, error) {
+	if meta.SealedName == nil {
+		return meta, fmt.Errorf("no sealed name")
+	}
+	name, err := openName(s.keys.Key, meta.SealedName)
+	if err != nil {
+		return meta, err
+	}
+	// Shards of an object, and its superseded versions, all carry the name of
+	// the object.
+	base, _, _ := shardOf(meta.Key)
+	wire, version, versioned := parseVersionKey(base)
+	if s.wireKey(name) != wire {
+		return meta, fmt.Errorf("sealed name does not match")
+	}
+
+	meta.Key = name
+	if versioned {
+		meta.Key = versionKey(name, version)
+	}
+	meta.SealedName = nil
+	return meta, nil
+}
+
+// PutOpts are the per object options of StoreWithOpts.
+type PutOpts struct {
+	// TTL is how long the object is kept, here and on every replica, before
+	// being swept away. Zero keeps it forever.
+	TTL time.Duration
+	// ContentType is the media type of the object, sniffed from its first
+	// bytes when empty.
+	ContentType string
+}
+
+func (s *FileServer) Store(key string, r io.Reader) error {
+	return s.StoreWithOpts(key, r, PutOpts{})
+}
+
+func (s *FileServer) StoreWithOpts(key string, r io.Reader, opts PutOpts) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	span := s.Tracer.Start(TraceContext{}, "Store")
+	span.SetAttrs("key", key)
+	start := time.Now()
+	err := s.put(span.Context(), key, r, opts)
+	s.metrics.observe("store", start, err)
+	span.End(err)
+	return err
+}
+
+func (s *FileServer) put(tc TraceContext, key string, r io.Reader, opts PutOpts) error {
+	// store this file to the disk
+	// broadcast this file to all known peers which will in turn broadcast to all their
+	// known peers on the network. Is broadcasting a whole file okay ?
+	var (
+		fileBuffer = new(bytes.Buffer)
+		tee        = io.TeeReader(r, fileBuffer)
+		meta       Metadata
+	)
+
+	if opts.TTL > 0 {
+		meta.Expires = time.Now().Add(opts.TTL).UTC()
+	}
+	meta.ContentType = opts.ContentType
+
+	meta, err := s.write(tc, key, meta, tee)
+	if err != nil {
+		return err
+	}
+
+	if s.Convergent {
+		return s.replicateConvergent(tc, key, meta, fileBuffer.Bytes())
+	}
+	return s.replicate(tc, key, meta, fileBuffer)
+}
+
+// write writes a new version of our key from r, with meta, and returns the
+// metadata it was written with.
+func (s *FileServer) write(tc TraceContext, key string, meta Metadata, r io.Reader) (Metadata, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// Writing a key never destroys what it held before, that becomes the
+	// previous version. A write that fails leaves it the current one.
+	var (
+		cur      Metadata
+		archived bool
+	)
+	if have, err := s.store.Stat(s.ID, key); err == nil {
+		aspan := s.Tracer.Start(tc, "archive")
+		archived, err = s.archive(s.ID, key, have)
+		aspan.End(err)
+		if err != nil {
+			return meta, err
+		}
+		cur = have
+	}
+	// Other nodes of ours may have written the key since, and we may only
+	// hold a replica of what they wrote. The new version has to know of that
+	// too, or it would conflict with it.
+	seen := s.replicaMeta(key)
+	meta.Version = nextVersion(max(cur.Version, seen.Version))
+	meta.Clock = cur.Clock.merge(seen.Clock).tick(s.NodeID)
+	meta.Node = s.NodeID
+
+	wspan := s.Tracer.Start(tc, "disk write")
+	n, err := s.store.WriteWithMeta(s.ID, key, meta, r)
+	wspan.SetAttrs("bytes", n)
+	wspan.End(err)
+	if err != nil {
+		if archived {
+			err = errors.Join(err, s.unarchive(s.ID, key, cur))
+		}
+		return meta, err
+	}
+
+	return s.store.Stat(s.ID, key)
+}
+
+// replicate encrypts r with the key derived for it from the active key and
+// hands a copy of it to every peer, under the hashed name of key.
+func (s *FileServer) replicate(tc TraceContext, key string, meta Metadata, r io.Reader) error {
+	// Peers only ever get to see the encrypted copy. It is produced once and
+	// the same bytes go out to every peer.
+	wire := s.wireKey(key)
+
+	span := s.Tracer.Start(tc, "encrypt")
+	encBuffer := new(bytes.Buffer)
+	n, err := copyEncrypt(objectKey(s.keys.Active(), wire), r, encBuffer)
+	span.SetAttrs("bytes", n)
+	span.End(err)
+	if err != nil {
+		return err
+	}
+
+	meta, err = s.wireMeta(key, meta)
+	if err != nil {
+		return err
+	}
+
+	if s.DataShards > 0 {
+		return s.pushShards(tc, s.ID, wire, meta, encBuffer.Bytes())
+	}
+	return s.push(tc, s.ID, wire, meta, encBuffer.Bytes())
+}
+
+// wireMeta returns meta as it is handed to peers along with the encrypted
+// copy of key. The name is sealed, and the checksum and content type of the
+// plaintext, which would let a peer confirm a guess at the content, are left
+// out.
+func (s *FileServer) wireMeta(key string, meta Metadata) (Metadata, error) {
+	sealed, err := sealName(s.keys.Active(), key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta.Key = s.wireKey(key)
+	meta.SealedName = sealed
+	meta.Checksum = ""
+	meta.ContentType = "application/octet-stream"
+	return meta, nil
+}
+
+// replicateConvergent hands the convergent blob of plaintext to every peer,
+// followed by the reference to it, encrypted under our own key, as (key).
+func (s *FileServer) replicateConvergent(tc TraceContext, key string, meta Metadata, plaintext []byte) error {
+	contentKey := convergentKey(plaintext)
+
+	span := s.Tracer.Start(tc, "encrypt")
+	blob := new(bytes.Buffer)
+	n, err := copyEncryptConvergent(contentKey, bytes.NewReader(plaintext), blob)
+	span.SetAttrs("bytes", n, "convergent", true)
+	span.End(err)
+	if err != nil {
+		return err
+	}
+
+	ref := convergentRef{
+		Blob: blobKey(blob.Bytes()),
+		Key:  contentKey,
+	}
+
+	blobMeta := Metadata{
+		ContentType: "application/octet-stream",
+		Created:     meta.Created,
+	}
+	push := s.push
+	if s.DataShards > 0 {
+		push = s.pushShards
+	}
+	if err := push(tc, convergentID, ref.Blob, blobMeta, blob.Bytes()); err != nil {
+		return err
+	}
+
+	refBuffer := new(bytes.Buffer)
+	if err := writeConvergentRef(refBuffer, ref); err != nil {
+		return err
+	}
+	return s.replicate(tc, key, meta, refBuffer)
+}
+
+// push sends the already encrypted object data to every peer, to be stored as
+// (id, key).
+func (s *FileServer) push(tc TraceContext, id string, key string, meta Metadata, data []byte) (err error) {
+	span := s.Tracer.Start(tc, "push")
+	span.SetAttrs("owner", id, "key", key, "bytes", len(data))
+	defer func() { span.End(err) }()
+
+	peers := s.connectedPeers()
+	reqID, answers, done := s.expectStored(len(peers))
+	defer done()
+
+	msg := Message{
+		Trace: span.Context(),
+		Payload: MessageStoreFile{
+			RequestID: reqID,
+			ID:        id,
+			Key:       key,
+			Size:      int64(len(data)),
+			Meta:      meta,
+		},
+	}
+
+	errs := func() []error {
+		s.lockStreams(span.Context())
+		defer s.streamLock.Unlock()
+
+		bspan := s.Tracer.Start(span.Context(), "broadcast")
+		reached, err := s.broadcastTo(peers, &msg)
+		bspan.End(err)
+		peers = reached
+
+		time.Sleep(time.Millisecond * 5)
+
+		// Every peer that got the message waits on the stream following it,
+		// one failing is no reason to leave the others hanging.
+		errs := []error{err}
+		for _, peer := range peers {
+			errs = append(errs, s.sendStream(span.Context(), peer, id, key, data))
+		}
+		return errs
+	}()
+
+	errs = append(errs, s.awaitStored(span.Context(), key, answers, peers))
+	return errors.Join(errs...)
+}
+
+// storeAnswer is the answer of the peer from to a push, err telling why it
+// refused it if it did.
+type storeAnswer struct {
+	from string
+	err  error
+}
+
+// expectStored registers a push about to be answered by up to n peers. It
+// returns the request ID of the push, the channel the answers of the peers
+// are delivered on, and a func to call once done with them.
+func (s *FileServer) expectStored(n int) (string, chan storeAnswer, func()) {
+	reqID := generateID()
+	answers := make(chan storeAnswer, n)
+
+	s.storeLock.Lock()
+	s.stores[reqID] = answers
+	s.storeLock.Unlock()
+
+	return reqID, answers, func() {
+		s.storeLock.Lock()
+		delete(s.stores, reqID)
+		s.storeLock.Unlock()
+	}
+}
+
+// awaitStored waits for peers to answer a push of key, and returns the
+// reasons of those that refused it. Peers going away in the meantime are not
+// waited on. It must not be called with streamLock held, or peers asking us
+// for something in the meantime would keep us from reading their answers.
+func (s *FileServer) awaitStored(tc TraceContext, key string, answers chan storeAnswer, peers []p2p.Peer) error {
+	span := s.Tracer.Start(tc, "wait for peers")
+	span.SetAttrs("peers", len(peers))
+
+	pending := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		pending[peer.RemoteAddr().String()] = true
+	}
+
+	var (
+		errs    []error
+		timeout = time.After(storeTimeout)
+		ticker  = time.NewTicker(time.Millisecond * 100)
+	)
+	defer ticker.Stop()
+
+	for len(pending) > 0 {
+		select {
+		case answer := <-answers:
+			if pending[answer.from] {
+				delete(pending, answer.from)
+				errs = append(errs, answer.err)
+			}
+		case <-ticker.C:
+			for addr := range pending {
+				if _, ok := s.peer(addr); !ok {
+					delete(pending, addr)
+					errs = append(errs, fmt.Errorf("[%s] peer (%s) went away before storing (%s)", s.Transport.Addr(), addr, key))
+				}
+			}
+		case <-timeout:
+			for addr := range pending {
+				delete(pending, addr)
+				errs = append(errs, fmt.Errorf("[%s] peer (%s) did not tell whether it stored (%s)", s.Transport.Addr(), addr, key))
+			}
+		}
+	}
+
+	err := errors.Join(errs...)
+	span.End(err)
+	return err
+}
+
+// sendStream sends data as a stream to peer, following the message
+// announcing it.
+func (s *FileServer) sendStream(tc TraceContext, peer p2p.Peer, id string, key string, data []byte) error {
+	span := s.Tracer.Start(tc, "send")
+	span.SetAttrs("peer", peer.RemoteAddr().String())
+	defer s.streaming(peer)()
+
+	peer.Send([]byte{p2p.IncomingStream})
+	n, err := io.Copy(peer, bytes.NewReader(data))
+	span.SetAttrs("bytes", n)
+	span.End(err)
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Info("sent object", "peer", peer.RemoteAddr().String(), "owner", id, "key", key, "bytes", n)
+	return nil
+}
+
+// streaming counts a stream as being sent to peer until the returned func is
+// called.
+func (s *FileServer) streaming(peer p2p.Peer) func() {
+	addr := peer.RemoteAddr().String()
+
+	s.peerLock.Lock()
+	s.streams[addr]++
+	s.peerLock.Unlock()
+
+	return func() {
+		s.peerLock.Lock()
+		if s.streams[addr]--; s.streams[addr] <= 0 {
+			delete(s.streams, addr)
+		}
+		s.peerLock.Unlock()
+	}
+}
+
+// lockStreams takes the stream lock, in a span of its own as it may be a
+// while before it is free.
+func (s *FileServer) lockStreams(tc TraceContext) {
+	span := s.Tracer.Start(tc, "wait for stream lock")
+	s.streamLock.Lock()
+	span.End(nil)
+}
+
+// pushTo sends the already encrypted object data to a single peer, to be
+// stored as (id, key).
+func (s *FileServer) pushTo(tc TraceContext, peer p2p.Peer, id string, key string, meta Metadata, data []byte) (err error) {
+	span := s.Tracer.Start(tc, "push")
+	span.SetAttrs("owner", id, "key", key, "bytes", len(data))
+	defer func() { span.End(err) }()
+
+	reqID, answers, done := s.expectStored(1)
+	defer done()
+
+	msg := Message{
+		Trace: span.Context(),
+		Payload: MessageStoreFile{
+			RequestID: reqID,
+			ID:        id,
+			Key:       key,
+			Size:      int64(len(data)),
+			Meta:      meta,
+		},
+	}
+
+	err = func() error {
+		s.lockStreams(span.Context())
+		defer s.streamLock.Unlock()
+
+		if err := s.send(peer, &msg); err != nil {
+			return err
+		}
+
+		time.Sleep(time.Millisecond * 5)
+
+		return s.sendStream(span.Context(), peer, id, key, data)
+	}()
+	if err != nil {
+		return err
+	}
+
+	return s.awaitStored(span.Context(), key, answers, []p2p.Peer{peer})
+}
+
+// Delete removes one of our objects, every version of it included, from this
+// node and all of its peers.
+func (s *FileServer) Delete(key string) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	span := s.Tracer.Start(TraceContext{}, "Delete")
+	span.SetAttrs("key", key)
+	start := time.Now()
+	err := s.remove(span.Context(), key)
+	s.metrics.observe("delete", start, err)
+	span.End(err)
+	return err
+}
+
+func (s *FileServer) remove(tc TraceContext, key string) error {
+	if _, _, err := s.purge(s.ID, key, false); err != nil {
+		return err
+	}
+
+	msg := Message{
+		Trace: tc,
+		Payload: MessageDeleteFile{
+			ID:  s.ID,
+			Key: s.wireKey(key),
+		},
+	}
+	return s.broadcast(&msg)
+}
+
+// purge deletes the object (id, key) along with its superseded versions and,
+// if shards is set, its shards. It returns how many objects it deleted and how
+// many bytes that freed.
+func (s *FileServer) purge(id string, key string, shards bool) (int, int64, error) {
+	var held []Metadata
+	if meta, err := s.store.Stat(id, key); err == nil {
+		held = append(held, meta)
+	}
+	if shards {
+		res, err := s.store.List(id, ListOpts{Prefix: key + ".shard"})
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, meta := range res.Entries {
+			if base, _, ok := shardOf(meta.Key); ok && base == key {
+				held = append(held, meta)
+			}
+		}
+	}
+
+	res, err := s.store.List(versionsID(id), ListOpts{Prefix: key + "@"})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, meta := range res.Entries {
+		base, _, _ := shardOf(meta.Key)
+		if name, _, ok := parseVersionKey(base); ok && name == key {
+			held = append(held, meta)
+		}
+	}
+
+	var (
+		n     int
+		freed int64
+		// byPeer is what was freed of what every peer host had us hold.
+		byPeer = map[string]int64{}
+	)
+	for _, meta := range held {
+		if err := s.store.Delete(meta.Owner, meta.Key); err != nil {
+			return n, freed, err
+		}
+		n++
+		freed += meta.Size
+		byPeer[meta.From] += meta.Size
+	}
+
+	if ownerOf(id) != s.ID && freed > 0 {
+		usage, err := s.ledger()
+		if err != nil {
+			return n, freed, err
+		}
+		for peer, size := range byPeer {
+			if err := usage.add(ownerOf(id), peer, -size); err != nil {
+				return n, freed, err
+			}
+		}
+	}
+
+	return n, freed, nil
+}
+
+// RotateKey switches the node to a fresh encryption key and returns its ID.
+// The copies held by peers are then re-encrypted under the new key in the
+// background, from the plaintext objects this node holds.
+func (s *FileServer) RotateKey() (string, error) {
+	id, err := s.keys.Rotate()
+	if err != nil {
+		return "", err
+	}
+
+	s.spawn(func() { s.reencrypt(id) })
+
+	return id, nil
+}
+
+func (s *FileServer) reencrypt(keyID string) {
+	var (
+		opts  = ListOpts{Limit: 100}
+		done  int
+		start = time.Now()
+	)
+
+	for {
+		res, err := s.store.List(s.ID, opts)
+		if err != nil {
+			s.Logger.Error("re-encryption stopped", "key_id", keyID, "err", err)
+			return
+		}
 
-	store *Store
-	quit  chan struct{}
-}
+		for _, meta := range res.Entries {
+			if s.isStopping() {
+				s.Logger.Warn("re-encryption stopped", "key_id", keyID, "err", errServerStopped)
+				return
+			}
+			if s.keys.ActiveID() != keyID {
+				s.Logger.Info("key was rotated out, stopping its re-encryption", "key_id", keyID)
+				return
+			}
 
-func NewFileServer(opts FileServerOPts) *FileServer {
-	storeOpts := StoreOpts{
-		Root:              opts.StoreageRoot,
-		PathTransformFunc: opts.PathTransformFunc,
-	}
+			_, r, err := s.store.Read(s.ID, meta.Key)
+			if err != nil {
+				s.Logger.Error("re-encrypting object", "key", meta.Key, "err", err)
+				continue
+			}
+			span := s.Tracer.Start(TraceContext{}, "reencrypt")
+			span.SetAttrs("key_id", keyID)
+			err = s.replicate(span.Context(), meta.Key, meta, r)
+			span.End(err)
+			if rc, ok := r.(io.Closer); ok {
+				rc.Close()
+			}
+			if err != nil {
+				s.Logger.Error("re-encrypting object", "key", meta.Key, "err", err)
+				continue
+			}
+			done++
+		}
 
-	return &FileServer{
-		FileServerOPts: opts,
-		store:          NewStore(storeOpts),
-		quit:           make(chan struct{}),
-		peers:          make(map[string]p2p.Peer),
+		if res.Next == "" {
+			break
+		}
+		opts.After = res.Next
 	}
-}
 
-type Message struct {
-	Payload any
+	s.Logger.Info("re-encrypted objects", "key_id", keyID, "objects", done, "duration", time.Since(start))
 }
 
-type MessageStoreFile struct {
-	Key  string
-	Size int64
-}
+// Stop stops the server, giving operations in flight up to stopTimeout to
+// complete. See StopContext.
+func (s *FileServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
 
-type MessageGetFile struct {
-	Key string
+	return s.StopContext(ctx)
 }
 
-func (s *FileServer) stream(msg *Message) error {
-	fmt.Println("start boradcast ?")
-	peers := []io.Writer{}
+// StopContext stops the server. New peers are turned away and new operations
+// fail right away, while those in flight are given until ctx is done to
+// complete, after which they are cut short by closing the connections under
+// them. Peers are then told goodbye and every connection is closed.
+// StopContext returns once every goroutine of the server and its transport
+// has exited, with an error if operations had to be cut short. Calling it
+// again waits for the first call and returns the same.
+func (s *FileServer) StopContext(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		s.stopErr = s.shutdown(ctx)
+	})
+	return s.stopErr
+}
 
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
-	}
+func (s *FileServer) shutdown(ctx context.Context) error {
+	s.stopLock.Lock()
+	close(s.stopping)
+	s.stopLock.Unlock()
 
-	mw := io.MultiWriter(peers...)
-	return gob.NewEncoder(mw).Encode(msg)
-}
+	// Whatever is still reading from or writing to a peer when ctx is done
+	// fails once the connection is gone.
+	abort := context.AfterFunc(ctx, s.closePeers)
 
-func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
-	}
+	s.ops.Wait()
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+	// Handlers serving peers hold the stream lock for as long as they are
+	// streaming, the goodbye can't be sent in the middle of that.
+	s.streamLock.Lock()
+	for _, peer := range s.connectedPeers() {
+		if err := s.send(peer, &Message{Payload: MessageGoodbye{}}); err != nil {
+			s.Logger.Warn("saying goodbye", "peer", peer.RemoteAddr().String(), "err", err)
 		}
 	}
+	s.streamLock.Unlock()
 
+	s.closePeers()
+	close(s.quit)
+	s.wg.Wait()
+
+	if !abort() {
+		return fmt.Errorf("stopping file server: operations in flight were cut short: %w", ctx.Err())
+	}
 	return nil
 }
 
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.store.Has(key) {
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
+// begin registers an operation the server has to wait for when stopping, to be
+// ended with s.end. It fails once the server is stopping.
+func (s *FileServer) begin() error {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
 
-		_, r, err := s.store.Read(key)
-		return r, err
+	if s.isStopping() {
+		return errServerStopped
 	}
+	s.ops.Add(1)
+	s.inflight.Add(1)
+	return nil
+}
+
+func (s *FileServer) end() {
+	s.inflight.Add(-1)
+	s.ops.Done()
+}
 
-	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+// spawn runs f in a goroutine the server waits for when stopping, unless it is
+// stopping already. It returns whether f was run.
+func (s *FileServer) spawn(f func()) bool {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
 
-	msg := Message{
-		Payload: MessageGetFile{
-			Key: key,
-		},
+	if s.isStopping() {
+		return false
 	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+	return true
+}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+func (s *FileServer) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
 	}
+}
 
-	time.Sleep(time.Millisecond * 500)
+// connectedPeers returns the peers we are connected to.
+func (s *FileServer) connectedPeers() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
+	peers := make([]p2p.Peer, 0, len(s.peers))
 	for _, peer := range s.peers {
-		// First read the file size so we can limit the amout of bytes that we read
-		// from the connection to the file szie, so we don't keep it hanging.
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
-		n, err := s.store.Write(key, io.LimitReader(peer, fileSize))
-		if err != nil {
-			return nil, err
-		}
-		log.Printf("[%s] received (%d) bytes from the network from (%s)", s.Transport.Addr(), n, peer.RemoteAddr())
-
-		peer.CloseStream()
+		peers = append(peers, peer)
 	}
-
-	_, r, err := s.store.Read(key)
-	return r, err
+	return peers
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
-	// store this file to the disk
-	// broadcast this file to all known peers which will in turn broadcast to all their
-	// known peers on the network. Is broadcasting a whole file okay ?
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+// peer returns the peer we are connected to at addr.
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
-	size, err := s.store.Write(key, tee)
-	if err != nil {
-		return err
-	}
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			Key:  key,
-			Size: size,
-		},
-	}
+// closePeers closes the connection to every peer and forgets about them.
+func (s *FileServer) closePeers() {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	for addr, peer := range s.peers {
+		peer.Close()
+		delete(s.peers, addr)
 	}
+}
 
-	time.Sleep(time.Millisecond * 5)
-
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingStream})
-		n, err := io.Copy(peer, fileBuffer)
-		if err != nil {
-			fmt.Println("is there error at rread level ?")
-			return err
-		}
+// Peers returns the addresses of the peers we are connected to, sorted.
+func (s *FileServer) Peers() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
-		fmt.Println("sent and written bytes to disk: ", n)
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		addrs = append(addrs, addr)
 	}
-
-	return nil
-
-	// buf := new(bytes.Buffer)
-	// tee := io.TeeReader(r, buf)
-	// if err := s.store.Write(key, tee); err != nil {
-	// 	return err
-	// }
-	//
-	// p := &DataMessage{
-	// 	Key:  key,
-	// 	Data: buf.Bytes(),
-	// }
-	//
-	// return s.broadcast(&Message{
-	// 	From:    s.Transport.ListeAddr(),
-	// 	Payload: p,
-	// })
-}
-
-func (s *FileServer) Stop() {
-	close(s.quit)
+	sort.Strings(addrs)
+	return addrs
 }
 
 func (s *FileServer) onPeer(peer p2p.Peer) error {
+	if s.isStopping() {
+		return errServerStopped
+	}
+
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
 	s.peers[peer.RemoteAddr().String()] = peer
 
-	log.Println("connected with remote ", peer.RemoteAddr())
+	s.Logger.Info("connected with peer", "peer", peer.RemoteAddr().String())
 
-	// Yeah true doing this just to satisfy definition of the required function is not normal
 	return nil
 }
 
 func (s *FileServer) loop() {
 	defer func() {
-		log.Println("File server stopped due to error or user quit action")
+		s.Logger.Info("file server stopped")
 		s.Transport.Close()
 	}()
 
@@ -209,11 +1413,13 @@ func (s *FileServer) loop() {
 		case rpc := <-s.Transport.Consume():
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Println("decoding error: ", err)
+				s.metrics.decodeErrors.Add(1)
+				s.Logger.Error("decoding message", "peer", rpc.From, "err", err)
+				continue
 			}
 
 			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("handle message error: ", err)
+				s.Logger.Error("handling message", "peer", rpc.From, "type", fmt.Sprintf("%T", msg.Payload), "err", err)
 			}
 		case <-s.quit:
 			return
@@ -221,86 +1427,475 @@ func (s *FileServer) loop() {
 	}
 }
 
+// handleMessage handles a message of a peer, in a span under the one it was
+// sent under.
 func (s *FileServer) handleMessage(from string, msg *Message) error {
+	name := fmt.Sprintf("%T", msg.Payload)
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+
+	span := s.Tracer.Start(msg.Trace, "handle "+name)
+	span.SetAttrs("peer", from)
+	err := s.dispatch(span.Context(), from, msg)
+	span.End(err)
+	return err
+}
+
+func (s *FileServer) dispatch(tc TraceContext, from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+		return s.handleMessageStoreFile(tc, from, v)
+
+	case MessageStored:
+		return s.handleMessageStored(from, v)
+
+	case MessageStoreRejected:
+		return s.handleMessageStoreRejected(from, v)
+
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+
+	case MessageGoodbye:
+		return s.handleMessageGoodbye(from)
 
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(tc, from, v)
+
+	case MessageGetShards:
+		return s.handleMessageGetShards(tc, from, v)
+
+	case MessageListFiles:
+		return s.handleMessageListFiles(tc, from, v)
+
+	case MessageListFilesResult:
+		return s.handleMessageListFilesResult(from, v)
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	n, freed, err := s.purge(msg.ID, msg.Key, true)
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Info("deleted object", "peer", from, "owner", msg.ID, "key", msg.Key, "objects", n, "bytes", freed)
+	return nil
+}
+
+func (s *FileServer) handleMessageGoodbye(from string) error {
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	delete(s.peers, from)
+	s.peerLock.Unlock()
+	if !ok {
+		return nil
 	}
 
+	s.Logger.Info("peer said goodbye", "peer", from)
+	// It may well have closed the connection already.
+	peer.Close()
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	log.Printf("searching for file (%s) on peer (%s)\n", msg.Key, from)
+func (s *FileServer) handleMessageGetFile(tc TraceContext, from string, msg MessageGetFile) error {
+	start := time.Now()
+	s.Logger.Debug("peer asked for object", "peer", from, "owner", msg.ID, "key", msg.Key)
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	s.lockStreams(tc)
+	defer s.streamLock.Unlock()
 
 	// Many te could return a list of peers that could have the file requested for
 	// if it doesn't have it ?
-	if !s.store.Has(msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+	id, key := s.resolveVersion(msg.ID, msg.Key)
+	if !s.has(id, key) {
+		sendNotHeld(peer)
+		s.Logger.Debug("object asked for not held", "peer", from, "owner", msg.ID, "key", msg.Key)
+		return nil
 	}
 
-	log.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
-	fileSize, r, err := s.store.Read(msg.Key)
+	fileSize, r, err := s.store.Read(id, key)
 	if err != nil {
+		// Held a moment ago, but the peer is waiting on an answer all the
+		// same.
+		sendNotHeld(peer)
 		return err
 	}
 
 	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("Closing readCloser")
 		defer rc.Close()
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
-	}
-
 	// First send hte "incomingStream" byte ot the peer and then we can send the
 	// file as an int64
+	span := s.Tracer.Start(tc, "send")
+	defer s.streaming(peer)()
 	peer.Send([]byte{p2p.IncomingStream})
 	binary.Write(peer, binary.LittleEndian, fileSize)
 	n, err := io.Copy(peer, r)
+	span.SetAttrs("bytes", n)
+	span.End(err)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	s.Logger.Info("served object", "peer", from, "owner", msg.ID, "key", msg.Key, "bytes", n, "duration", time.Since(start))
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+// sendNotHeld answers a peer that asked for an object we don't hold, so it
+// doesn't wait on us forever.
+func sendNotHeld(peer p2p.Peer) {
+	peer.Send([]byte{p2p.IncomingStream})
+	binary.Write(peer, binary.LittleEndian, int64(-1))
+}
+
+func (s *FileServer) handleMessageListFiles(tc TraceContext, from string, msg MessageListFiles) error {
+	res, err := s.store.List(msg.ID, msg.Opts)
+	if err != nil {
+		return err
+	}
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	return s.send(peer, &Message{
+		Trace: tc,
+		Payload: MessageListFilesResult{
+			RequestID: msg.RequestID,
+			Result:    res,
+		},
+	})
+}
+
+func (s *FileServer) handleMessageListFilesResult(from string, msg MessageListFilesResult) error {
+	s.listLock.Lock()
+	results, ok := s.lists[msg.RequestID]
+	s.listLock.Unlock()
+	if !ok {
+		// The List call already gave up on this request.
+		return nil
+	}
+
+	select {
+	case results <- msg.Result:
+	default:
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreFile(tc TraceContext, from string, msg MessageStoreFile) error {
+	start := time.Now()
+
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	n, err := s.store.Write(msg.Key, io.LimitReader(peer, msg.Size))
+	lr := newStreamReader(peer, msg.Size)
+
+	// What we hold for others is charged to the peer that sent it, by host
+	// since its port changes with every connection.
+	host, _, err := net.SplitHostPort(from)
 	if err != nil {
-		return err
+		host = from
+	}
+	msg.Meta.From = host
+
+	// Convergent blobs are named after the hash of their content, which is
+	// checked below as they are written, so holding one already means
+	// holding these exact bytes. Shards of a blob can't be checked against
+	// its name on their own, and are written over instead.
+	_, _, shard := shardOf(msg.Key)
+	blob := msg.ID == convergentID && !shard
+	if blob && s.store.Has(msg.ID, msg.Key) {
+		io.Copy(io.Discard, lr)
+		peer.CloseStream()
+		s.Logger.Debug("already holding blob, skipped", "peer", from, "key", msg.Key)
+		return s.stored(tc, peer, msg)
+	}
+
+	// Versions may arrive in any order. The newest is kept as the current
+	// one, and the others are filed away among the superseded versions.
+	var (
+		id, key  = msg.ID, msg.Key
+		archive  bool
+		replaced int64
+	)
+	cur, err := s.store.Stat(msg.ID, msg.Key)
+	if err == nil && msg.ID == convergentID {
+		replaced = cur.Size
+	} else if err == nil {
+		order, sibling := s.settle(msg.Meta, cur)
+		switch order {
+		case clockEqual:
+			replaced = cur.Size
+		case clockAfter:
+			archive = true
+			cur.Sibling = sibling
+		default:
+			msg.Meta.Sibling = sibling
+			id, key = versionsID(msg.ID), archiveKey(msg.Key, msg.Meta.Version)
+			if s.store.Has(id, key) {
+				io.Copy(io.Discard, lr)
+				peer.CloseStream()
+				s.Logger.Debug("already holding version, skipped", "peer", from, "owner", msg.ID, "key", msg.Key, "version", msg.Meta.Version)
+				return s.stored(tc, peer, msg)
+			}
+		}
+	}
+
+	peerDelta := msg.Size
+	if cur.From == host {
+		peerDelta -= replaced
+	}
+	usage, err := s.ledger()
+	if err == nil {
+		err = usage.check(msg.ID, host, msg.Size-replaced, peerDelta, s.quotaFor(msg.ID), s.peerQuota(), s.GlobalQuota)
+	}
+	if err != nil {
+		// The stream is on its way regardless, and has to come off the
+		// connection before it can be handed back to the transport.
+		io.Copy(io.Discard, lr)
+		peer.CloseStream()
+		return s.reject(tc, peer, msg, err)
+	}
+
+	var archived bool
+	if archive {
+		aspan := s.Tracer.Start(tc, "archive")
+		archived, err = s.archive(msg.ID, msg.Key, cur)
+		aspan.End(err)
+		if err != nil {
+			io.Copy(io.Discard, lr)
+			peer.CloseStream()
+			return errors.Join(err, s.reject(tc, peer, msg, err))
+		}
+	}
+
+	// The stream is written as it comes off the connection, the time spent
+	// waiting on it tells the network apart from the disk.
+	wspan := s.Tracer.Start(tc, "disk write")
+	var (
+		hash = sha256.New()
+		r    = io.Reader(lr)
+	)
+	if blob {
+		r = io.TeeReader(lr, hash)
+	}
+	tr := &timedReader{r: r}
+	n, err := s.store.WriteWithMeta(id, key, msg.Meta, tr)
+	wspan.SetAttrs("bytes", n, "network_wait", tr.wait)
+	wspan.End(err)
+	if err != nil {
+		// What we held is still there, and still charged as it was.
+		io.Copy(io.Discard, lr)
+		peer.CloseStream()
+		if archived {
+			err = errors.Join(err, s.unarchive(msg.ID, msg.Key, cur))
+		}
+		return errors.Join(err, s.reject(tc, peer, msg, err))
+	}
+
+	if blob && hex.EncodeToString(hash.Sum(nil)) != msg.Key {
+		peer.CloseStream()
+		if err := s.store.Delete(id, key); err != nil {
+			return err
+		}
+		err := fmt.Errorf("blob (%s) from peer (%s) does not hash to its name", msg.Key, from)
+		return errors.Join(err, s.reject(tc, peer, msg, err))
 	}
 
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
-	// peer.(*p2p.TCPPeer).Wg.Done()
+	s.Logger.Info("stored object", "peer", from, "owner", msg.ID, "key", msg.Key, "bytes", n, "duration", time.Since(start))
 	peer.CloseStream()
 
+	if !msg.Meta.Created.IsZero() {
+		s.metrics.replicationLag.observe(time.Since(msg.Meta.Created).Seconds())
+	}
+
+	if replaced > 0 && cur.From != host {
+		if err := usage.add(msg.ID, cur.From, -replaced); err != nil {
+			return err
+		}
+		replaced = 0
+	}
+	if err := usage.add(msg.ID, host, n-replaced); err != nil {
+		return err
+	}
+
+	if err := s.stored(tc, peer, msg); err != nil {
+		return err
+	}
+
+	// Another node running under our ID wrote one of our keys.
+	if msg.ID == s.ID && id == msg.ID && !shard {
+		aspan := s.Tracer.Start(tc, "adopt")
+		err := s.adopt(msg.Meta)
+		aspan.End(err)
+		return err
+	}
+	return nil
+}
+
+// streamReader reads a stream of a known size off a peer connection. Unlike
+// an io.LimitReader, it fails rather than ending early when the connection
+// does, so that whatever it is written to isn't left half written.
+type streamReader struct {
+	r    io.Reader
+	left int64
+}
+
+func newStreamReader(r io.Reader, size int64) *streamReader {
+	return &streamReader{r: r, left: size}
+}
+
+func (sr *streamReader) Read(b []byte) (int, error) {
+	if sr.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > sr.left {
+		b = b[:sr.left]
+	}
+
+	n, err := sr.r.Read(b)
+	sr.left -= int64(n)
+	if err == io.EOF && sr.left > 0 {
+		err = errTruncatedTransfer
+	}
+	return n, err
+}
+
+// reject lets the sender of msg know we did not store it.
+func (s *FileServer) reject(tc TraceContext, peer p2p.Peer, msg MessageStoreFile, reason error) error {
+	s.Logger.Warn("rejecting object", "peer", peer.RemoteAddr().String(), "owner", msg.ID, "key", msg.Key, "bytes", msg.Size, "err", reason)
+
+	return s.send(peer, &Message{
+		Trace: tc,
+		Payload: MessageStoreRejected{
+			RequestID: msg.RequestID,
+			ID:        msg.ID,
+			Key:       msg.Key,
+			Reason:    reason.Error(),
+		},
+	})
+}
+
+// stored tells the sender of msg that its object was stored.
+func (s *FileServer) stored(tc TraceContext, peer p2p.Peer, msg MessageStoreFile) error {
+	return s.send(peer, &Message{
+		Trace:   tc,
+		Payload: MessageStored{RequestID: msg.RequestID},
+	})
+}
+
+func (s *FileServer) handleMessageStored(from string, msg MessageStored) error {
+	s.answerStore(msg.RequestID, storeAnswer{from: from})
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreRejected(from string, msg MessageStoreRejected) error {
+	s.Logger.Warn("peer refused to store object", "peer", from, "key", msg.Key, "err", msg.Reason)
+	s.answerStore(msg.RequestID, storeAnswer{
+		from: from,
+		err:  fmt.Errorf("[%s] %w (%s): %s", from, errStoreRejected, msg.Key, msg.Reason),
+	})
 	return nil
 }
 
+// answerStore hands the answer of a peer to the push reqID waiting on it.
+func (s *FileServer) answerStore(reqID string, answer storeAnswer) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	answers, ok := s.stores[reqID]
+	if !ok {
+		// The push already gave up on this request.
+		return
+	}
+	select {
+	case answers <- answer:
+	default:
+	}
+}
+
+// ledger returns the usage ledger of the server, loading it the first time.
+func (s *FileServer) ledger() (*usageLedger, error) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	if s.usage != nil {
+		return s.usage, nil
+	}
+
+	usage, err := openUsageLedger(s.StoreageRoot)
+	if err != nil {
+		return nil, fmt.Errorf("opening usage ledger: %w", err)
+	}
+	s.usage = usage
+	return usage, nil
+}
+
+// quotaFor returns the quota of owner, zero meaning no cap.
+func (s *FileServer) quotaFor(owner string) int64 {
+	if quota, ok := s.OwnerQuotas[owner]; ok {
+		return quota
+	}
+	return s.OwnerQuota
+}
+
+// peerQuota returns the quota of every peer host, which doesn't depend on
+// the owner IDs it claims.
+func (s *FileServer) peerQuota() int64 {
+	if s.PeerQuota > 0 {
+		return s.PeerQuota
+	}
+	return s.OwnerQuota
+}
+
+// Usage returns how many bytes this node holds on behalf of every other
+// owner.
+func (s *FileServer) Usage() (map[string]int64, error) {
+	usage, err := s.ledger()
+	if err != nil {
+		return nil, err
+	}
+	return usage.snapshot(), nil
+}
+
 func (s *FileServer) bootstrapNetwork() {
 	for _, addr := range s.BootstrapNodes {
-		go func(addr string) {
-			fmt.Println("attempting to connect with remote: ", addr)
+		s.spawn(func() {
+			s.Logger.Debug("dialing bootstrap node", "peer", addr)
 			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
+				s.Logger.Error("dialing bootstrap node", "peer", addr, "err", err)
 			}
-		}(addr)
+		})
 	}
 }
 
+// Start runs the server until it is stopped.
 func (s *FileServer) Start() error {
+	// Stop waits for the loop like for any other goroutine of the server.
+	s.stopLock.Lock()
+	if s.isStopping() {
+		s.stopLock.Unlock()
+		return errServerStopped
+	}
+	s.wg.Add(1)
+	s.started = time.Now()
+	s.stopLock.Unlock()
+	defer s.wg.Done()
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
@@ -309,6 +1904,8 @@ func (s *FileServer) Start() error {
 		s.bootstrapNetwork()
 	}
 
+	s.spawn(s.sweepLoop)
+
 	s.loop()
 
 	return nil
@@ -316,5 +1913,12 @@ func (s *FileServer) Start() error {
 
 func init() {
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStored{})
+	gob.Register(MessageStoreRejected{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageGoodbye{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetShards{})
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageListFilesResult{})
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func newTestNode(t *testing.T, addr string, logger *slog.Logger, bootstrap ...string) *FileServer {
+	t.Helper()
+
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    addr,
+		Decoder:       p2p.DefaultDecoder{},
+		HandShakeFunc: p2p.DefaultHandSake,
+		Logger:        logger,
+	})
+	s := NewFileServer(FileServerOPts{
+		StoreageRoot:   t.TempDir(),
+		Storage:        NewMemoryStore(),
+		Transport:      tr,
+		BootstrapNodes: bootstrap,
+		Logger:         logger,
+	})
+	tr.OnPeer = s.onPeer
+	return s
+}
+
+// waitFor polls cond for up to a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestStop(t *testing.T) {
+	logs := new(bytes.Buffer)
+	addrA := freeAddr(t)
+	a := newTestNode(t, addrA, slog.New(slog.NewJSONHandler(logs, nil)))
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	defer a.Stop()
+
+	// Give a the time to listen before b dials it.
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, addrA)
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	if err := b.Store("notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replica", func() bool {
+		res, err := a.store.List(b.ID, ListOpts{})
+		return err == nil && len(res.Entries) == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.StopContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-bErr:
+		if err != nil {
+			t.Errorf("start returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("start still running after stop returned")
+	}
+	if peers := b.Peers(); len(peers) != 0 {
+		t.Errorf("stopped node still has peers %v", peers)
+	}
+
+	waitFor(t, "a to be told goodbye", func() bool {
+		return len(a.Peers()) == 0
+	})
+
+	if err := b.Store("late.txt", strings.NewReader("too late")); !errors.Is(err, errServerStopped) {
+		t.Errorf("store after stop: have %v want %v", err, errServerStopped)
+	}
+	if err := b.Stop(); err != nil {
+		t.Errorf("stopping twice: %v", err)
+	}
+	if err := b.Start(); !errors.Is(err, errServerStopped) {
+		t.Errorf("start after stop: have %v want %v", err, errServerStopped)
+	}
+
+	if err := a.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-aErr; err != nil {
+		t.Errorf("start returned %v", err)
+	}
+
+	// Everything a logged carries its address, and what is about a peer the
+	// address of the peer.
+	var stored, goodbye bool
+	dec := json.NewDecoder(logs)
+	for {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			break
+		}
+		if record["node"] != addrA {
+			t.Errorf("record without the node address: %v", record)
+		}
+		switch record["msg"] {
+		case "stored object":
+			stored = record["owner"] == b.ID && record["bytes"] != nil && record["peer"] != nil && record["duration"] != nil
+		case "peer said goodbye":
+			goodbye = record["peer"] != nil
+		}
+	}
+	if !stored || !goodbye {
+		t.Errorf("missing records, stored object: %v, goodbye: %v", stored, goodbye)
+	}
+}
+
+func TestStopMidTransfer(t *testing.T) {
+	addr := freeAddr(t)
+	s := newTestNode(t, addr, nil)
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Announce an object and only send part of it.
+	buf := new(bytes.Buffer)
+	msg := Message{Payload: MessageStoreFile{ID: "owner", Key: "big", Size: 1 << 20}}
+	if err := gob.NewEncoder(buf).Encode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(p2p.EncodeMessage(buf.Bytes()))
+	conn.Write([]byte{p2p.IncomingStream})
+	conn.Write(make([]byte, 1024))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.StopContext(ctx) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stop: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop hung on a transfer in flight")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("start returned %v", err)
+	}
+	if s.store.Has("owner", "big") {
+		t.Error("half received object was kept")
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	r := newStreamReader(strings.NewReader("0123456789"), 4)
+	if b, err := io.ReadAll(r); err != nil || string(b) != "0123" {
+		t.Errorf("have %q, %v want %q", b, err, "0123")
+	}
+
+	// A connection ending early fails the write instead of leaving half of
+	// the object behind.
+	store := NewMemoryStore()
+	r = newStreamReader(strings.NewReader("0123"), 10)
+	if _, err := store.WriteWithMeta("id", "key", Metadata{}, r); !errors.Is(err, errTruncatedTransfer) {
+		t.Errorf("have %v want %v", err, errTruncatedTransfer)
+	}
+	if store.Has("id", "key") {
+		t.Error("truncated object was stored")
+	}
+}
+
+func TestGoodbyeDuringBroadcast(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	c := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	cErr := make(chan error, 1)
+	go func() { cErr <- c.Start() }()
+	waitFor(t, "b and c to connect", func() bool {
+		return len(a.Peers()) == 2
+	})
+
+	// c says goodbye while a is busy broadcasting to it. Stores caught in
+	// the middle of it may fail, but must not bring a down.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			a.Store(fmt.Sprintf("key-%d", i), strings.NewReader("hello"))
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	waitFor(t, "a to be told goodbye", func() bool {
+		return len(a.Peers()) == 1
+	})
+	if err := a.Store("after", strings.NewReader("hello")); err != nil {
+		t.Fatalf("store once c is gone: %v", err)
+	}
+	waitFor(t, "the replica on b", func() bool {
+		_, err := b.store.Stat(a.ID, a.wireKey("after"))
+		return err == nil
+	})
+
+	b.Stop()
+	a.Stop()
+	for _, errc := range []chan error{aErr, bErr, cErr} {
+		if err := <-errc; err != nil {
+			t.Errorf("start returned %v", err)
+		}
+	}
+}
+
+func TestReplicaMeta(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	if err := b.Store("notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	local, err := b.store.Stat(b.ID, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replica Metadata
+	waitFor(t, "the replica", func() bool {
+		replica, err = a.store.Stat(b.ID, b.wireKey("notes.txt"))
+		return err == nil
+	})
+	// Nothing about the plaintext is there for a to check a guess against.
+	if replica.Checksum == local.Checksum {
+		t.Errorf("replica carries the checksum of the plaintext %s", local.Checksum)
+	}
+	if replica.ContentType != "application/octet-stream" {
+		t.Errorf("replica carries the content type %q", replica.ContentType)
+	}
+
+	// The names b recovers from the replicas are still its own.
+	if err := b.store.Delete(b.ID, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := b.List(b.ID, ListOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Key != "notes.txt" {
+		t.Errorf("list: %+v", res.Entries)
+	}
+
+	b.Stop()
+	a.Stop()
+	<-aErr
+	<-bErr
+}
+
+// unreadableStore holds its objects but fails to read them back.
+type unreadableStore struct {
+	Storage
+}
+
+var errUnreadable = errors.New("unreadable")
+
+func (s *unreadableStore) Read(id string, key string) (int64, io.Reader, error) {
+	return 0, nil, errUnreadable
+}
+
+func TestGetUnreadableReplica(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	store := &unreadableStore{Storage: a.store}
+	a.store = store
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	if err := b.Store("notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.store.Delete(b.ID, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a holds the replica but can't read it, and says so rather than
+	// leaving b waiting on it.
+	got := make(chan error, 1)
+	go func() {
+		_, err := b.Get("notes.txt")
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err == nil {
+			t.Errorf("got an object no peer could read")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("get still waiting on a peer that can't read the object")
+	}
+
+	b.Stop()
+	a.Stop()
+	<-aErr
+	<-bErr
+}
+
+func TestConvergentBlobChecked(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	blob := []byte("the blob")
+	name := blobKey(blob)
+
+	// Bytes that don't hash to the name are thrown away, rather than taking
+	// the place of the blob for good.
+	if err := b.push(TraceContext{}, convergentID, name, Metadata{}, []byte("not the blob")); !errors.Is(err, errStoreRejected) {
+		t.Fatalf("have %v want %v", err, errStoreRejected)
+	}
+	if err := b.push(TraceContext{}, convergentID, name, Metadata{}, blob); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the blob", func() bool {
+		_, r, err := a.store.Read(convergentID, name)
+		if err != nil {
+			return false
+		}
+		got, _ := io.ReadAll(r)
+		return bytes.Equal(got, blob)
+	})
+	if usage, _ := a.Usage(); usage[convergentID] != int64(len(blob)) {
+		t.Errorf("usage: have %d want %d", usage[convergentID], len(blob))
+	}
+
+	b.Stop()
+	a.Stop()
+	<-aErr
+	<-bErr
+}
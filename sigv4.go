@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests to the gateway are authenticated with AWS Signature Version 4,
+// either from the Authorization header or from the query of a presigned URL.
+// Bodies signed chunk by chunk have every chunk checked against its
+// signature, which chains it to the chunk before and the first chunk to the
+// seed signature covering the headers. The trailers such bodies may end with
+// are not checked, nothing is made of them.
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4MaxSkew    = 15 * time.Minute
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// streamingPayload starts the payload hash of bodies signed chunk by
+	// chunk, with or without trailers.
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// sigV4 is what a request says about how it was signed.
+type sigV4 struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	// expires is set on presigned URLs.
+	expires time.Duration
+}
+
+func (v sigV4) scope() string {
+	return strings.Join([]string{v.date, v.region, v.service, "aws4_request"}, "/")
+}
+
+// authenticate checks the signature of r, returning its body to read from in
+// place of r.Body, decoded if it was sent in signed chunks.
+func (g *Gateway) authenticate(r *http.Request) (io.ReadCloser, error) {
+	if g.AccessKey == "" || g.SecretKey == "" {
+		if isAWSChunked(r) {
+			return readCloser{newAWSChunkedReader(r.Body), r.Body}, nil
+		}
+		return r.Body, nil
+	}
+
+	v, err := parseSigV4(r)
+	if err != nil {
+		return nil, err
+	}
+	if v.accessKey != g.AccessKey || v.region != g.Region || v.service != "s3" {
+		return nil, errS3AccessDenied
+	}
+
+	now := time.Now()
+	if v.expires > 0 {
+		if now.After(v.amzDate.Add(v.expires)) {
+			return nil, errS3AccessDenied
+		}
+	} else if now.Sub(v.amzDate).Abs() > sigV4MaxSkew {
+		return nil, errS3TimeSkewed
+	}
+
+	key := sigV4Key(g.SecretKey, v)
+	want := sigV4Sign(key, v, canonicalRequest(r, v))
+	if !hmac.Equal([]byte(want), []byte(v.signature)) {
+		return nil, errS3SignatureMismatch
+	}
+
+	// Only the payload hash that was signed tells how the body was sent:
+	// an unsigned Content-Encoding must not get a signed body past its hash.
+	if strings.HasPrefix(v.payloadHash, "STREAMING-") {
+		c := newAWSChunkedReader(r.Body)
+		if strings.HasPrefix(v.payloadHash, streamingPayload) {
+			c.signer = &chunkSigner{
+				key:   key,
+				date:  v.amzDate.UTC().Format(sigV4TimeFormat),
+				scope: v.scope(),
+				prev:  v.signature,
+			}
+		}
+		return readCloser{c, r.Body}, nil
+	}
+
+	// A body signed along with the headers has to match the hash it was
+	// signed with, the hash of no body at all included.
+	if len(v.payloadHash) == sha256.Size*2 {
+		return readCloser{&hashingReader{r: r.Body, hash: sha256.New(), want: v.payloadHash}, r.Body}, nil
+	}
+	return r.Body, nil
+}
+
+func parseSigV4(r *http.Request) (sigV4, error) {
+	var (
+		v          sigV4
+		credential string
+		signed     string
+		amzDate    string
+	)
+
+	q := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		params, ok := strings.CutPrefix(auth, sigV4Algorithm+" ")
+		if !ok {
+			return v, errS3AccessDenied
+		}
+		for _, param := range strings.Split(params, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signed = value
+			case "Signature":
+				v.signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		v.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if v.payloadHash == "" {
+			v.payloadHash = emptySHA256
+		}
+	} else if q.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		credential = q.Get("X-Amz-Credential")
+		signed = q.Get("X-Amz-SignedHeaders")
+		v.signature = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		v.payloadHash = unsignedPayload
+
+		secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || secs <= 0 {
+			return v, errS3AccessDenied
+		}
+		v.expires = time.Duration(secs) * time.Second
+	} else {
+		return v, errS3AccessDenied
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || signed == "" || v.signature == "" {
+		return v, errS3AccessDenied
+	}
+	v.accessKey, v.date, v.region, v.service = parts[0], parts[1], parts[2], parts[3]
+	v.signedHeaders = strings.Split(signed, ";")
+
+	t, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil || t.Format("20060102") != v.date {
+		return v, errS3AccessDenied
+	}
+	v.amzDate = t
+
+	return v, nil
+}
+
+// canonicalRequest is the request r as it was signed.
+func canonicalRequest(r *http.Request, v sigV4) string {
+	var query []string
+	for name, values := range r.URL.Query() {
+		if v.expires > 0 && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			query = append(query, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(query)
+
+	var headers strings.Builder
+	for _, name := range v.signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		default:
+			values = r.Header.Values(name)
+		}
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.Join(values, ","))
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(v.signedHeaders, ";"),
+		v.payloadHash,
+	}, "\n")
+}
+
+func sigV4Signature(secret string, v sigV4, canonical string) string {
+	return sigV4Sign(sigV4Key(secret, v), v, canonical)
+}
+
+// sigV4Key derives the key requests in the scope of v are signed with.
+func sigV4Key(secret string, v sigV4) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{v.date, v.region, v.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func sigV4Sign(key []byte, v sigV4, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		sigV4Algorithm,
+		v.amzDate.UTC().Format(sigV4TimeFormat),
+		v.scope(),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// chunkSigner signs the chunks of a body sent in
+// STREAMING-AWS4-HMAC-SHA256-PAYLOAD, each along with the signature of the
+// chunk before it, or the seed signature for the first one.
+type chunkSigner struct {
+	key   []byte
+	date  string
+	scope string
+	prev  string
+}
+
+// check checks signature against the chunk hashing to sum, moving on to the
+// next chunk if it matches.
+func (s *chunkSigner) check(sum []byte, signature string) error {
+	toSign := strings.Join([]string{
+		sigV4Algorithm + "-PAYLOAD",
+		s.date,
+		s.scope,
+		s.prev,
+		emptySHA256,
+		hex.EncodeToString(sum),
+	}, "\n")
+	want := hex.EncodeToString(hmacSHA256(s.key, toSign))
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return errS3SignatureMismatch
+	}
+	s.prev = want
+	return nil
+}
+
+// awsURIEncode escapes s the way AWS does when signing: every byte but the
+// unreserved characters, and slashes too unless in a path.
+func awsURIEncode(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isAWSChunked(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked")
+}
+
+// awsChunkedReader decodes a body sent in aws-chunked encoding: chunks each
+// preceded by their size in hex, optionally followed by their signature, and
+// ended by an empty chunk and the trailers, if any. With a signer, a read that
+// ends a chunk fails if the chunk doesn't match its signature.
+type awsChunkedReader struct {
+	r      *bufio.Reader
+	left   int64
+	done   bool
+	signer *chunkSigner
+	// hash and signature are those of the chunk being read.
+	hash      hash.Hash
+	signature string
+}
+
+func newAWSChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r)}
+}
+
+func (c *awsChunkedReader) Read(b []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.left == 0 {
+		line, err := c.readLine()
+		if err == io.EOF {
+			// The body has to end with the empty chunk, or chunks could be
+			// dropped from its end.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		size, params, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("aws-chunked: bad chunk header %q", line)
+		}
+		c.signature = ""
+		for _, param := range strings.Split(params, ";") {
+			if sig, ok := strings.CutPrefix(strings.TrimSpace(param), "chunk-signature="); ok {
+				c.signature = sig
+			}
+		}
+		c.hash = sha256.New()
+
+		if n == 0 {
+			if err := c.check(); err != nil {
+				return 0, err
+			}
+			// Trailers, if any, up to an empty line.
+			for {
+				line, err := c.readLine()
+				if err == io.EOF || (err == nil && line == "") {
+					break
+				}
+				if err != nil {
+					return 0, err
+				}
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = n
+	}
+
+	if int64(len(b)) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.r.Read(b)
+	c.left -= int64(n)
+	c.hash.Write(b[:n])
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if c.left == 0 {
+		if line, err := c.readLine(); err != nil || line != "" {
+			return n, fmt.Errorf("aws-chunked: chunk not followed by CRLF")
+		}
+		if err := c.check(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// check checks the chunk just read against its signature, if signed.
+func (c *awsChunkedReader) check() error {
+	if c.signer == nil {
+		return nil
+	}
+	return c.signer.check(c.hash.Sum(nil), c.signature)
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// hashingReader fails a read that ends a body not matching the hash it was
+// signed with, before whatever it is being stored as is complete.
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+}
+
+func (h *hashingReader) Read(b []byte) (int, error) {
+	n, err := h.r.Read(b)
+	h.hash.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.want {
+		return n, errS3BadDigest
+	}
+	return n, err
+}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
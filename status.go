@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"sort"
+	"time"
+)
+
+// Status is what a node tells about itself, see FileServer.Status.
+type Status struct {
+	ID     string
+	NodeID string
+	Addr   string
+	// SigningKey is the key the capabilities of the node are signed with,
+	// for other nodes to pin, see FileServerOpts.OwnerKeys.
+	SigningKey ed25519.PublicKey
+	// Started is when the node was started, zero if it was not, and Uptime
+	// how long ago that was.
+	Started time.Time
+	Uptime  time.Duration
+	Peers   []PeerStatus
+	// Objects and Bytes are what the store holds, replicas and versions
+	// included.
+	Objects int
+	Bytes   int64
+	// Usage is the bytes held on behalf of every other owner.
+	Usage map[string]int64
+	// Operations is how many Store, Get, Delete, List and other operations
+	// are in flight.
+	Operations int64
+}
+
+// PeerStatus is what a node tells about one of its peers.
+type PeerStatus struct {
+	Addr string
+	// Outbound is set when we dialed the peer, rather than it dialing us.
+	Outbound       bool
+	ConnectedSince time.Time
+	BytesReceived  int64
+	BytesSent      int64
+	// Streams is how many objects are being streamed to or from the peer.
+	Streams int
+}
+
+// peerInfo is implemented by peers telling about their connection, such as
+// p2p.TCPPeer.
+type peerInfo interface {
+	Outbound() bool
+	ConnectedAt() time.Time
+	Streaming() bool
+}
+
+// Status returns who the node is, who it is connected to and what it is
+// doing.
+func (s *FileServer) Status() (Status, error) {
+	usage, err := s.Usage()
+	if err != nil {
+		return Status{}, err
+	}
+	objects, size, err := s.storeSize()
+	if err != nil {
+		return Status{}, err
+	}
+
+	st := Status{
+		ID:         s.ID,
+		NodeID:     s.NodeID,
+		Addr:       s.Transport.Addr(),
+		SigningKey: s.keys.SigningKey().Public().(ed25519.PublicKey),
+		Peers:      s.peerStatus(),
+		Objects:    objects,
+		Bytes:      size,
+		Usage:      usage,
+		Operations: s.inflight.Load(),
+	}
+
+	s.stopLock.Lock()
+	st.Started = s.started
+	s.stopLock.Unlock()
+	if !st.Started.IsZero() {
+		st.Uptime = time.Since(st.Started)
+	}
+
+	return st, nil
+}
+
+// peerStatus returns the status of every connected peer, by address.
+func (s *FileServer) peerStatus() []PeerStatus {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]PeerStatus, 0, len(s.peers))
+	for addr, peer := range s.peers {
+		ps := PeerStatus{
+			Addr:    addr,
+			Streams: s.streams[addr],
+		}
+		if p, ok := peer.(peerInfo); ok {
+			ps.Outbound = p.Outbound()
+			ps.ConnectedSince = p.ConnectedAt()
+			if p.Streaming() {
+				ps.Streams++
+			}
+		}
+		if c, ok := peer.(peerCounter); ok {
+			ps.BytesReceived = c.BytesRead()
+			ps.BytesSent = c.BytesWritten()
+		}
+		peers = append(peers, ps)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr < peers[j].Addr })
+
+	return peers
+}
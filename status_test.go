@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	a := newTestNode(t, freeAddr(t), nil)
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	if err := b.Store("notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replica", func() bool {
+		res, err := a.store.List(b.ID, ListOpts{})
+		return err == nil && len(res.Entries) == 1
+	})
+
+	st, err := b.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != b.ID || st.NodeID != b.NodeID || st.Addr != b.Transport.Addr() {
+		t.Errorf("status of the wrong node: %+v", st)
+	}
+	if st.Started.IsZero() || st.Uptime <= 0 {
+		t.Errorf("uptime: started %v uptime %v", st.Started, st.Uptime)
+	}
+	if st.Objects != 1 || st.Bytes != 5 || st.Operations != 0 {
+		t.Errorf("objects %d bytes %d operations %d", st.Objects, st.Bytes, st.Operations)
+	}
+	if len(st.Peers) != 1 {
+		t.Fatalf("peers: %+v", st.Peers)
+	}
+	if p := st.Peers[0]; !p.Outbound || p.ConnectedSince.IsZero() || p.BytesSent == 0 || p.Streams != 0 {
+		t.Errorf("peer b dialed: %+v", p)
+	}
+
+	st, err = a.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Peers) != 1 || st.Peers[0].Outbound || st.Peers[0].BytesReceived == 0 {
+		t.Errorf("peer that dialed a: %+v", st.Peers)
+	}
+	if st.Usage[b.ID] == 0 {
+		t.Errorf("usage: %v", st.Usage)
+	}
+
+	// Operations are counted for as long as they are in flight.
+	if err := b.begin(); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := b.Status(); st.Operations != 1 {
+		t.Errorf("operations in flight: have %d want 1", st.Operations)
+	}
+	b.end()
+
+	// The commands, against b.
+	socket := filepath.Join(t.TempDir(), "rvt.sock")
+	control := NewControl(ControlOpts{SocketPath: socket, Server: b})
+	go control.ListenAndServe()
+	defer control.Close()
+
+	out := new(bytes.Buffer)
+	c := &cli{socketPath: socket, stdout: out, stderr: io.Discard}
+	for i := 0; i < 50; i++ {
+		if err := runStatus(c, nil); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(out.String(), b.NodeID) || !strings.Contains(out.String(), "1 objects") {
+		t.Errorf("status printed %q", out.String())
+	}
+
+	out.Reset()
+	if err := runPeers(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], a.Transport.Addr()) || !strings.Contains(lines[1], "outbound") {
+		t.Errorf("peers printed %q", out.String())
+	}
+
+	b.Stop()
+	a.Stop()
+	<-aErr
+	<-bErr
+}
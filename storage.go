@@ -0,0 +1,43 @@
+package main
+
+import "io"
+
+// Storage is anything that can hold the objects of a FileServer. Objects are
+// addressed by the ID of their owner and their key.
+type Storage interface {
+	Has(id string, key string) bool
+	Read(id string, key string) (int64, io.Reader, error)
+	Write(id string, key string, r io.Reader) (int64, error)
+	// WriteWithMeta writes the object like Write, keeping whatever fields of
+	// meta are already set instead of generating them.
+	WriteWithMeta(id string, key string, meta Metadata, r io.Reader) (int64, error)
+	Delete(id string, key string) error
+	List(id string, opts ListOpts) (ListResult, error)
+	// Owners returns the IDs of every owner the storage holds objects for.
+	Owners() ([]string, error)
+	Stat(id string, key string) (Metadata, error)
+	// Clear removes every object held by the storage.
+	Clear() error
+}
+
+var (
+	_ Storage = (*Store)(nil)
+	_ Storage = (*MemoryStore)(nil)
+	_ Storage = (*PackStore)(nil)
+)
+
+// writeDecrypt decrypts r on the fly into the object held for (id, key), with
+// meta as in WriteWithMeta. The object is only kept if the whole stream
+// decrypted fine.
+func writeDecrypt(s Storage, keys keyLookup, id string, key string, meta Metadata, r io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := copyDecryptWith(keys, r, pw)
+		pw.CloseWithError(err)
+	}()
+
+	n, err := s.WriteWithMeta(id, key, meta, pr)
+	// Unblock the decrypting goroutine if we stopped reading early.
+	pr.CloseWithError(err)
+	return n, err
+}
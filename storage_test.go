@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStorageBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) Storage{
+		"disk": func(t *testing.T) Storage {
+			return NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+		},
+		"disk-packed": func(t *testing.T) Storage {
+			return NewStore(StoreOpts{
+				Root:              t.TempDir(),
+				PathTransformFunc: CASPathTransformFunc,
+				PackThreshold:     16,
+				SegmentSize:       64,
+			})
+		},
+		"memory": func(t *testing.T) Storage {
+			return NewMemoryStore()
+		},
+		"pack": func(t *testing.T) Storage {
+			// A tiny segment size makes sure reads span several segments.
+			return NewPackStore(PackStoreOpts{Root: t.TempDir(), SegmentSize: 64})
+		},
+	}
+
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, newStorage(t))
+		})
+	}
+}
+
+func testStorage(t *testing.T, s Storage) {
+	id := generateID()
+	defer s.Clear()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("foo_%02d", i)
+		data := []byte(fmt.Sprintf("some jpg bytes %d", i))
+
+		n, err := s.Write(id, key, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) {
+			t.Errorf("have written %d bytes want %d", n, len(data))
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("foo_%02d", i)
+		want := fmt.Sprintf("some jpg bytes %d", i)
+
+		if !s.Has(id, key) {
+			t.Fatalf("expected to have key %s", key)
+		}
+
+		size, r, err := s.Read(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if string(b) != want || size != int64(len(want)) {
+			t.Errorf("have %q (%d) want %q", b, size, want)
+		}
+
+		meta, err := s.Stat(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Key != key || meta.Owner != id || meta.Size != size {
+			t.Errorf("unexpected metadata %+v", meta)
+		}
+	}
+
+	res, err := s.List(id, ListOpts{Prefix: "foo_1", Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 5 || res.Entries[0].Key != "foo_10" || res.Next != "foo_14" {
+		t.Errorf("unexpected list page %v next %q", res.Entries, res.Next)
+	}
+
+	owners, err := s.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(owners, id) {
+		t.Errorf("owner %s missing from %v", id, owners)
+	}
+
+	// An overwrite that fails half way leaves the object as it was.
+	errBoom := errors.New("boom")
+	partial := io.MultiReader(strings.NewReader(strings.Repeat("half written ", 4)), iotest.ErrReader(errBoom))
+	if _, err := s.Write(id, "foo_06", partial); !errors.Is(err, errBoom) {
+		t.Errorf("failed overwrite: have %v want %v", err, errBoom)
+	}
+	if _, r, err := s.Read(id, "foo_06"); err != nil {
+		t.Errorf("failed overwrite lost the object: %v", err)
+	} else {
+		b, _ := io.ReadAll(r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if string(b) != "some jpg bytes 6" {
+			t.Errorf("after a failed overwrite: have %q want %q", b, "some jpg bytes 6")
+		}
+	}
+	if meta, err := s.Stat(id, "foo_06"); err != nil || meta.Size != int64(len("some jpg bytes 6")) {
+		t.Errorf("after a failed overwrite: %+v, %v", meta, err)
+	}
+
+	if err := s.Delete(id, "foo_05"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "foo_05") {
+		t.Errorf("expected to NOT have key foo_05")
+	}
+	if _, err := s.Stat(id, "foo_05"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("have %v want %v", err, os.ErrNotExist)
+	}
+	if !s.Has(id, "foo_06") {
+		t.Errorf("deleting foo_05 removed foo_06 as well")
+	}
+
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "foo_06") {
+		t.Errorf("expected Clear to remove every object")
+	}
+}
+
+func TestStorePackedMode(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		PackThreshold:     8,
+		SegmentSize:       32,
+	})
+	id := generateID()
+
+	// Small objects go to segment files and never touch the CAS tree.
+	for i := 0; i < 16; i++ {
+		if _, err := s.Write(id, fmt.Sprintf("small_%02d", i), bytes.NewReader([]byte("tiny"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id)); !os.IsNotExist(err) {
+		t.Errorf("expected no per-object directories, have %v", err)
+	}
+
+	// Growing a packed object past the threshold moves it out of the packs.
+	big := bytes.Repeat([]byte("x"), 64)
+	if _, err := s.Write(id, "small_00", bytes.NewReader(big)); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s.Read(id, "small_00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if !bytes.Equal(b, big) {
+		t.Errorf("have %q want %q", b, big)
+	}
+	if s.packs.Has(id, "small_00") {
+		t.Errorf("expected small_00 to have left the packs")
+	}
+
+	for i := 1; i < 14; i++ {
+		if err := s.Delete(id, fmt.Sprintf("small_%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, _ := s.packs.segments()
+	reclaimed, err := s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed == 0 {
+		t.Errorf("expected compaction to reclaim some space")
+	}
+	after, _ := s.packs.segments()
+	if len(after) >= len(segments) {
+		t.Errorf("expected fewer segments after compaction, have %d had %d", len(after), len(segments))
+	}
+
+	for i := 14; i < 16; i++ {
+		key := fmt.Sprintf("small_%02d", i)
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if string(b) != "tiny" {
+			t.Errorf("%s: have %q after compaction", key, b)
+		}
+	}
+}
@@ -1,23 +1,32 @@
 package main
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 )
 
-const defaultRootFolderName = "rivulet"
+const (
+	defaultRootFolderName = "rivulet"
+	metaFileExt           = ".meta"
+	packFolderName        = "packs"
+)
 
 func CASPathTransformFunc(key string) PathKey {
-	hash := sha1.Sum([]byte(key))
+	hash := sha256.Sum256([]byte(key))
 	hashStr := hex.EncodeToString(hash[:])
 
-	blocksize := 5
+	blocksize := 8
 	sliceLen := len(hashStr) / blocksize
 	paths := make([]string, sliceLen)
 
@@ -55,6 +64,14 @@ type StoreOpts struct {
 	// Root is the root folder name, which holds the folders of the system.
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// PackThreshold turns on the packed mode when set: objects of at most
+	// this many bytes are appended to segment files under Root instead of
+	// getting a file (and a chain of directories) of their own.
+	PackThreshold int64
+	// SegmentSize is the size of the segment files used by the packed mode.
+	SegmentSize int64
+	// Logger is what the store logs to, nothing when left nil.
+	Logger *slog.Logger
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -66,6 +83,12 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 
 type Store struct {
 	StoreOpts
+
+	indexLock sync.Mutex
+	index     *keyIndex
+
+	// packs holds the small objects when the packed mode is on.
+	packs *PackStore
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -75,78 +98,343 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFolderName
 	}
+	if opts.Logger == nil {
+		opts.Logger = discardLogger()
+	}
 
-	return &Store{
+	s := &Store{
 		StoreOpts: opts,
 	}
+
+	if opts.PackThreshold > 0 {
+		s.packs = NewPackStore(PackStoreOpts{
+			Root:        filepath.Join(opts.Root, packFolderName),
+			SegmentSize: opts.SegmentSize,
+			Logger:      opts.Logger,
+		})
+	}
+
+	return s
+}
+
+// keys returns the key index of the store, loading it from disk the first
+// time it is needed.
+func (s *Store) keys() (*keyIndex, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if s.index == nil {
+		idx, err := openIndex(s.Root)
+		if err != nil {
+			return nil, fmt.Errorf("opening key index: %w", err)
+		}
+		s.index = idx
+	}
+
+	return s.index, nil
 }
 
 func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	idx, err := s.keys()
+	if err != nil {
+		s.Logger.Error("loading key index", "root", s.Root, "err", err)
+		return false
+	}
 
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, os.ErrNotExist)
+	if _, ok := idx.get(id, key); ok {
+		return true
+	}
+	return s.packs != nil && s.packs.Has(id, key)
 }
 
 func (s *Store) Clear() error {
+	if s.packs != nil {
+		if err := s.packs.Clear(); err != nil {
+			return err
+		}
+	}
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if s.index != nil {
+		s.index.close()
+		s.index = nil
+	}
+
 	return os.RemoveAll(s.Root)
 }
 
+// Delete removes exactly one object and prunes the directories it leaves
+// empty behind it.
 func (s *Store) Delete(id string, key string) error {
-	pathKey := s.PathTransformFunc(key)
+	if s.packs != nil {
+		if err := s.packs.Delete(id, key); err != nil {
+			return err
+		}
+	}
 
-	defer func() {
-		log.Printf("deleted [%s] from disk", pathKey.Filename)
-	}()
+	return s.deleteFile(id, key)
+}
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+func (s *Store) deleteFile(id string, key string) error {
+	idx, err := s.keys()
+	if err != nil {
+		return err
+	}
+
+	e, ok := idx.get(id, key)
+	if !ok {
+		return nil
+	}
+
+	fullPathWithRoot := filepath.Join(s.Root, e.Path)
+	if err := os.Remove(fullPathWithRoot); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := idx.del(id, key); err != nil {
+		return err
+	}
 
-	return os.RemoveAll(firstPathNameWithRoot)
+	s.prune(filepath.Dir(fullPathWithRoot), filepath.Join(s.Root, id))
+
+	s.Logger.Debug("deleted object from disk", "owner", id, "key", key, "path", e.Path)
+	return nil
+}
+
+// prune removes dir and its parents as long as they are empty, stopping at
+// stop, which is kept even if empty.
+func (s *Store) prune(dir string, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		// os.Remove refuses to remove directories that still hold anything.
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
+// WriteWithMeta writes the object like Write, but starts from the given
+// metadata instead of an empty record. Replicas use it so they carry the same
+// key name, content type and creation time as the owner.
+func (s *Store) WriteWithMeta(id string, key string, meta Metadata, r io.Reader) (int64, error) {
+	if s.packs == nil {
+		return s.commit(id, key, meta, r)
+	}
+
+	// Peek one byte past the threshold to find out whether the object is
+	// small enough to be packed.
+	head := make([]byte, s.PackThreshold+1)
+	n, err := io.ReadFull(r, head)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		written, err := s.packs.WriteWithMeta(id, key, meta, bytes.NewReader(head[:n]))
+		if err != nil {
+			return written, err
+		}
+		// The key may have been a large object before.
+		return written, s.deleteFile(id, key)
+	case err != nil:
+		return 0, err
+	}
+
+	written, err := s.commit(id, key, meta, io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return written, err
+	}
+	return written, s.packs.Delete(id, key)
+}
+
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	return writeDecrypt(s, newMemoryKeystore(encKey).Key, id, key, Metadata{}, r)
+}
+
+// Compact reclaims the space left behind by deleted and overwritten packed
+// objects and returns the number of bytes reclaimed. It is a no-op when the
+// packed mode is off.
+func (s *Store) Compact() (int64, error) {
+	if s.packs == nil {
+		return 0, nil
+	}
+	return s.packs.Compact()
+}
+
+// Stat returns the metadata recorded for the given key.
+func (s *Store) Stat(id string, key string) (Metadata, error) {
+	idx, err := s.keys()
 	if err != nil {
-		return 0, err
+		return Metadata{}, err
+	}
+
+	e, ok := idx.get(id, key)
+	if !ok {
+		if s.packs != nil {
+			return s.packs.Stat(id, key)
+		}
+		return Metadata{}, fmt.Errorf("stat %s: %w", key, os.ErrNotExist)
 	}
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+
+	return e.Meta, nil
 }
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
+// ListOpts narrows down and pages through the keys returned by List.
+type ListOpts struct {
+	// Prefix only keeps keys starting with it.
+	Prefix string
+	// After skips every key up to and including it. Pass the Next value of a
+	// previous ListResult to fetch the following page.
+	After string
+	// Limit caps the number of entries returned. Zero means no limit.
+	Limit int
+}
+
+type ListResult struct {
+	Entries []Metadata
+	// Next is set to the last returned key when there are more entries left.
+	Next string
+}
+
+// List returns the metadata of every object held for id, sorted by key.
+func (s *Store) List(id string, opts ListOpts) (ListResult, error) {
+	idx, err := s.keys()
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	entries := idx.list(id)
+	if s.packs != nil {
+		packed, err := s.packs.List(id, ListOpts{})
+		if err != nil {
+			return ListResult{}, err
+		}
+		entries = append(entries, packed.Entries...)
+	}
+
+	return paginate(entries, opts), nil
+}
+
+func (s *Store) Owners() ([]string, error) {
+	idx, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := idx.owners()
+	if s.packs != nil {
+		packed, err := s.packs.Owners()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range packed {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// paginate sorts entries by key and applies opts to them.
+func paginate(entries []Metadata, opts ListOpts) ListResult {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	var res ListResult
+	for _, meta := range entries {
+		if !strings.HasPrefix(meta.Key, opts.Prefix) || meta.Key <= opts.After {
+			continue
+		}
+		if opts.Limit > 0 && len(res.Entries) == opts.Limit {
+			res.Next = res.Entries[len(res.Entries)-1].Key
+			break
+		}
+		res.Entries = append(res.Entries, meta)
+	}
+
+	return res
+}
+
+// openFileForWriting creates a temporary file next to where the object goes,
+// to be renamed over it once it is complete, and returns it along with that
+// path.
+func (s *Store) openFileForWriting(id string, key string) (*os.File, string, error) {
 	pathKey := s.PathTransformFunc(key)
 	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
 	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
-	return os.Create(fullPathWithRoot)
+	f, err := os.CreateTemp(pathNameWithRoot, "."+pathKey.Filename+".*")
+	return f, fullPathWithRoot, err
 }
 
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	return s.WriteWithMeta(id, key, Metadata{}, r)
+}
+
+// commit copies r into a new object file and only then puts it in place of
+// the one the key held, if any, and records it in the key index. A copy that
+// fails leaves the key as it was.
+func (s *Store) commit(id string, key string, meta Metadata, r io.Reader) (int64, error) {
+	idx, err := s.keys()
+	if err != nil {
+		return 0, err
+	}
+
+	f, path, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+	defer os.Remove(f.Name())
+
+	mw := newMetaWriter()
+	n, err := io.Copy(io.MultiWriter(f, mw), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return n, err
+	}
+
+	meta.Key = key
+	meta.Owner = id
+	mw.fill(&meta)
+
+	rel := fmt.Sprintf("%s/%s", id, s.PathTransformFunc(key).FullPath())
+	return n, idx.put(id, key, indexEntry{Path: rel, Meta: meta})
 }
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
+	if s.packs != nil && s.packs.Has(id, key) {
+		return s.packs.Read(id, key)
+	}
 	return s.readStream(id, key)
 }
 
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	idx, err := s.keys()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	e, ok := idx.get(id, key)
+	if !ok {
+		return 0, nil, fmt.Errorf("read %s: %w", key, os.ErrNotExist)
+	}
 
-	file, err := os.Open(fullPathWithRoot)
+	file, err := os.Open(filepath.Join(s.Root, e.Path))
 	if err != nil {
 		return 0, nil, err
 	}
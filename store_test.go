@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"io"
 	"testing"
+	"time"
 )
 
 func TestPathTransformFunc(t *testing.T) {
 	key := "momsbestpicture"
 	pathKey := CASPathTransformFunc(key)
-	expectedFilename := "6804429f74181a63c50c3d81d733a12f14a353ff"
-	expectedPathName := "68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff"
+	expectedFilename := "b159a9f0a78305c07dbce386598952bfa30b6aabb46a98b072c9195348abf9ea"
+	expectedPathName := "b159a9f0/a78305c0/7dbce386/598952bf/a30b6aab/b46a98b0/72c91953/48abf9ea"
 	if pathKey.PathName != expectedPathName {
 		t.Errorf("have %s want %s", pathKey.PathName, expectedPathName)
 	}
@@ -58,6 +59,94 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreStat(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "momsbestpicture"
+	data := []byte("<html><body>hello</body></html>")
+	if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := s.Stat(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Key != key {
+		t.Errorf("have key %s want %s", meta.Key, key)
+	}
+	if meta.Owner != id {
+		t.Errorf("have owner %s want %s", meta.Owner, id)
+	}
+	if meta.Size != int64(len(data)) {
+		t.Errorf("have size %d want %d", meta.Size, len(data))
+	}
+	if meta.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("have content type %s", meta.ContentType)
+	}
+	if want := "85052df661cd7c51a9e04eff2a91ed8fc1aa833e95fa0dab4c7cec102cabcb31"; meta.Checksum != want {
+		t.Errorf("have checksum %s want %s", meta.Checksum, want)
+	}
+
+	// A replica keeps the owner's creation time and content type.
+	replica := Metadata{ContentType: "image/jpeg", Created: meta.Created.Add(-time.Hour)}
+	if _, err := s.WriteWithMeta(id, "replica", replica, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Stat(id, "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ContentType != replica.ContentType || !got.Created.Equal(replica.Created) {
+		t.Errorf("replica metadata not preserved: %+v", got)
+	}
+	if got.Checksum != meta.Checksum {
+		t.Errorf("have checksum %s want %s", got.Checksum, meta.Checksum)
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	for _, key := range []string{"logs/b", "img/a", "logs/a", "logs/c", "img/b"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := s.List(id, ListOpts{Prefix: "logs/", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 2 || res.Entries[0].Key != "logs/a" || res.Entries[1].Key != "logs/b" {
+		t.Fatalf("unexpected first page %+v", res.Entries)
+	}
+	if res.Next != "logs/b" {
+		t.Errorf("have next %q want %q", res.Next, "logs/b")
+	}
+
+	res, err = s.List(id, ListOpts{Prefix: "logs/", After: res.Next, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Key != "logs/c" || res.Next != "" {
+		t.Fatalf("unexpected last page %+v next %q", res.Entries, res.Next)
+	}
+
+	res, err = s.List(generateID(), ListOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 0 {
+		t.Errorf("expected no entries for unknown id, have %d", len(res.Entries))
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"time"
+)
+
+const defaultSweepInterval = time.Minute
+
+// SweepReport tells what a sweep reclaimed.
+type SweepReport struct {
+	// Objects is how many expired objects were deleted.
+	Objects int
+	// Versions is how many superseded versions were pruned.
+	Versions int
+	Bytes    int64
+	// Owners is how many objects were reclaimed per owner.
+	Owners map[string]int
+	// Compacted is how many bytes of dead space compacting the store
+	// reclaimed, see Store.Compact.
+	Compacted int64
+}
+
+// compacter is implemented by storage that only reclaims the space of
+// deleted objects once compacted, such as Store in the packed mode.
+type compacter interface {
+	Compact() (int64, error)
+}
+
+// has reports whether the object (id, key) is held and not yet expired.
+// Expired objects are gone as far as anyone asking is concerned, even before
+// the sweeper gets to them.
+func (s *FileServer) has(id string, key string) bool {
+	meta, err := s.store.Stat(id, key)
+	return err == nil && !meta.expired(time.Now())
+}
+
+// Sweep deletes every expired object held, ours and those held on behalf of
+// other owners alike, prunes the superseded versions the version policy no
+// longer keeps, and then compacts the store.
+func (s *FileServer) Sweep() (SweepReport, error) {
+	report := SweepReport{Owners: make(map[string]int)}
+
+	owners, err := s.store.Owners()
+	if err != nil {
+		return report, err
+	}
+
+	usage, err := s.ledger()
+	if err != nil {
+		return report, err
+	}
+
+	now := time.Now()
+	for _, id := range owners {
+		res, err := s.store.List(id, ListOpts{})
+		if err != nil {
+			return report, err
+		}
+
+		for _, meta := range res.Entries {
+			if !meta.expired(now) {
+				continue
+			}
+			if err := s.store.Delete(id, meta.Key); err != nil {
+				s.Logger.Error("sweeping object", "owner", id, "key", meta.Key, "err", err)
+				continue
+			}
+
+			report.Objects++
+			report.Bytes += meta.Size
+			report.Owners[ownerOf(id)]++
+
+			if ownerOf(id) != s.ID {
+				if err := usage.add(ownerOf(id), meta.From, -meta.Size); err != nil {
+					return report, err
+				}
+			}
+		}
+
+		if id != ownerOf(id) {
+			if err := s.pruneVersions(id, now, &report, usage); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	// Deleted objects, swept away or not, may have only left dead space
+	// behind them.
+	if c, ok := s.store.(compacter); ok {
+		n, err := c.Compact()
+		report.Compacted = n
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+func (s *FileServer) sweepLoop() {
+	interval := s.SweepInterval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report, err := s.Sweep()
+			if err != nil {
+				s.Logger.Error("sweep failed", "err", err)
+			}
+			if report.Objects > 0 || report.Versions > 0 {
+				s.Logger.Info("swept expired objects and old versions", "objects", report.Objects, "versions", report.Versions, "bytes", report.Bytes, "owners", report.Owners)
+			}
+			if report.Compacted > 0 {
+				s.Logger.Info("compacted store", "bytes", report.Compacted)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
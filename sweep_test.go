@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSweep(t *testing.T) {
+	s := NewFileServer(FileServerOPts{Storage: NewMemoryStore()})
+
+	if err := s.StoreWithOpts("artifact", bytes.NewReader([]byte("Foo not bar")), PutOpts{TTL: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store("keeper", bytes.NewReader([]byte("Foo not bar"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replica held for someone else, accounted against its owner.
+	replica := Metadata{Expires: time.Now().Add(-time.Second), From: "10.0.0.1"}
+	n, err := s.store.WriteWithMeta("other", "replica", replica, bytes.NewReader([]byte("Bar not foo!")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := s.ledger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := usage.add("other", "10.0.0.1", n); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 5)
+
+	if _, err := s.Get("artifact"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expired object: have %v want %v", err, os.ErrNotExist)
+	}
+
+	report, err := s.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 2 || report.Bytes != 23 || report.Owners["other"] != 1 {
+		t.Errorf("have %+v want 2 objects of 23 bytes", report)
+	}
+
+	if s.store.Has(s.ID, "artifact") || s.store.Has("other", "replica") {
+		t.Errorf("expired objects survived the sweep")
+	}
+	if !s.store.Has(s.ID, "keeper") {
+		t.Errorf("sweep took an object without a TTL")
+	}
+	if held, _ := s.Usage(); held["other"] != 0 {
+		t.Errorf("have %d bytes accounted to other want 0", held["other"])
+	}
+	if len(usage.peers) != 0 {
+		t.Errorf("have %v accounted to peers want none", usage.peers)
+	}
+}
+
+func TestSweepCompacts(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage: NewStore(StoreOpts{
+			Root:              t.TempDir(),
+			PathTransformFunc: CASPathTransformFunc,
+			PackThreshold:     32,
+			SegmentSize:       64,
+		}),
+	})
+
+	// Enough small objects to fill several segments, all of them expiring.
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("artifact_%02d", i)
+		if err := s.StoreWithOpts(key, bytes.NewReader([]byte("Foo not bar")), PutOpts{TTL: time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Store("keeper", bytes.NewReader([]byte("Foo not bar"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 5)
+
+	report, err := s.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 20 || report.Compacted == 0 {
+		t.Errorf("have %+v want 20 objects swept and their space reclaimed", report)
+	}
+
+	r, err := s.Get("keeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "Foo not bar" {
+		t.Errorf("after compaction: have %q want %q", b, "Foo not bar")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TraceContext identifies a span, and the trace it belongs to, across nodes.
+// It travels in the Message envelopes, so that the handling of a message on a
+// peer shows up under the span that sent it. The zero TraceContext is no span
+// at all.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (tc TraceContext) IsZero() bool {
+	return tc == TraceContext{}
+}
+
+// Tracer starts the spans a FileServer emits around the phases of its
+// operations and message handlers.
+type Tracer interface {
+	// Start starts a span named name, a child of parent, or the root of a new
+	// trace when parent is zero.
+	Start(parent TraceContext, name string) Span
+}
+
+// Span is one timed phase of an operation.
+type Span interface {
+	// Context returns the TraceContext children of the span are started
+	// under.
+	Context() TraceContext
+	// SetAttrs adds attributes to the span, given as alternating keys and
+	// values the way slog takes them.
+	SetAttrs(args ...any)
+	// End ends the span, marking it failed if err is not nil.
+	End(err error)
+}
+
+// noopTracer is the tracer of a FileServer given none.
+type noopTracer struct{}
+
+func (noopTracer) Start(parent TraceContext, name string) Span { return noopSpan{} }
+
+type noopSpan struct{}
+
+func (noopSpan) Context() TraceContext { return TraceContext{} }
+func (noopSpan) SetAttrs(args ...any)  {}
+func (noopSpan) End(err error)         {}
+
+type FileTracerOpts struct {
+	// Writer is where spans are written as they end, each as an OTLP/JSON
+	// ExportTraceServiceRequest on a line of its own, the format the
+	// OpenTelemetry Collector reads and writes trace files in.
+	Writer io.Writer
+	// ServiceName and InstanceID end up as the service.name and
+	// service.instance.id of the resource of every span. ServiceName is
+	// "rivulet" when left empty.
+	ServiceName string
+	InstanceID  string
+}
+
+// FileTracer is a Tracer writing finished spans to a file, or any writer.
+type FileTracer struct {
+	FileTracerOpts
+
+	mu sync.Mutex
+}
+
+func NewFileTracer(opts FileTracerOpts) *FileTracer {
+	if len(opts.ServiceName) == 0 {
+		opts.ServiceName = "rivulet"
+	}
+
+	return &FileTracer{
+		FileTracerOpts: opts,
+	}
+}
+
+func (t *FileTracer) Start(parent TraceContext, name string) Span {
+	s := &fileSpan{
+		t:      t,
+		name:   name,
+		parent: parent.SpanID,
+		start:  time.Now(),
+	}
+	s.tc.TraceID = parent.TraceID
+	if parent.IsZero() {
+		rand.Read(s.tc.TraceID[:])
+	}
+	rand.Read(s.tc.SpanID[:])
+	return s
+}
+
+type fileSpan struct {
+	t      *FileTracer
+	name   string
+	tc     TraceContext
+	parent [8]byte
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs []otlpKeyValue
+	ended bool
+}
+
+func (s *fileSpan) Context() TraceContext {
+	return s.tc
+}
+
+func (s *fileSpan) SetAttrs(args ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i+1 < len(args); i += 2 {
+		key, ok := args[i].(string)
+		if !ok {
+			key = fmt.Sprint(args[i])
+		}
+		s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: otlpValueOf(args[i+1])})
+	}
+}
+
+func (s *fileSpan) End(err error) {
+	end := time.Now()
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.tc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.tc.SpanID[:]),
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	s.mu.Unlock()
+
+	if s.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if err != nil {
+		span.Status = &otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+
+	s.t.write(span)
+}
+
+func (t *FileTracer) write(span otlpSpan) {
+	resource := []otlpKeyValue{{Key: "service.name", Value: otlpValueOf(t.ServiceName)}}
+	if t.InstanceID != "" {
+		resource = append(resource, otlpKeyValue{Key: "service.instance.id", Value: otlpValueOf(t.InstanceID)})
+	}
+
+	req := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: resource},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/kurocifer/rivulet"},
+			Spans: []otlpSpan{span},
+		}},
+	}}}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Writer.Write(append(b, '\n'))
+}
+
+// The OTLP/JSON encoding of traces. IDs are hex encoded and 64 bit integers
+// are strings, as the OTLP specification has them.
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func otlpValueOf(v any) otlpValue {
+	var i int64
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case int:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint64:
+		i = int64(v)
+	case time.Duration:
+		i = int64(v)
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+	s := strconv.FormatInt(i, 10)
+	return otlpValue{IntValue: &s}
+}
+
+// timedReader keeps track of the time spent waiting on reads from r, which
+// tells the time a transfer spent on the network from the time it spent on
+// whatever is done with the bytes read.
+type timedReader struct {
+	r    io.Reader
+	wait time.Duration
+}
+
+func (t *timedReader) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(b)
+	t.wait += time.Since(start)
+	return n, err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spans decodes the spans written by a FileTracer.
+func spans(t *testing.T, b []byte) []otlpSpan {
+	t.Helper()
+
+	var out []otlpSpan
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var req otlpTraces
+		if err := dec.Decode(&req); err == io.EOF {
+			return out
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				out = append(out, ss.Spans...)
+			}
+		}
+	}
+}
+
+func findSpan(spans []otlpSpan, name string, traceID string) (otlpSpan, bool) {
+	for _, span := range spans {
+		if span.Name == name && (traceID == "" || span.TraceID == traceID) {
+			return span, true
+		}
+	}
+	return otlpSpan{}, false
+}
+
+func hasAttr(span otlpSpan, key string) bool {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTracing(t *testing.T) {
+	tracesA, tracesB := new(bytes.Buffer), new(bytes.Buffer)
+
+	a := newTestNode(t, freeAddr(t), nil)
+	a.Tracer = NewFileTracer(FileTracerOpts{Writer: tracesA, InstanceID: "a"})
+	aErr := make(chan error, 1)
+	go func() { aErr <- a.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestNode(t, freeAddr(t), nil, a.Transport.Addr())
+	b.Tracer = NewFileTracer(FileTracerOpts{Writer: tracesB, InstanceID: "b"})
+	bErr := make(chan error, 1)
+	go func() { bErr <- b.Start() }()
+	waitFor(t, "b to connect", func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	})
+
+	if err := b.Store("notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replica", func() bool {
+		res, err := a.store.List(b.ID, ListOpts{})
+		return err == nil && len(res.Entries) == 1
+	})
+
+	// Lose our own copy, for Get to go to the network for it.
+	if err := b.store.Delete(b.ID, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Get("notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "hello" {
+		t.Fatalf("have %q want %q", got, "hello")
+	}
+
+	b.Stop()
+	a.Stop()
+	<-aErr
+	<-bErr
+
+	spansA, spansB := spans(t, tracesA.Bytes()), spans(t, tracesB.Bytes())
+
+	// The handling of the messages of b on a ends up in the traces of the
+	// operations of b that sent them.
+	for _, op := range []struct {
+		root, handler, phase string
+	}{
+		{"Store", "handle MessageStoreFile", "disk write"},
+		{"Get", "handle MessageGetFile", "send"},
+	} {
+		root, ok := findSpan(spansB, op.root, "")
+		if !ok {
+			t.Errorf("no %s span", op.root)
+			continue
+		}
+		if root.ParentSpanID != "" || root.Status != nil {
+			t.Errorf("%s: have parent %q status %v", op.root, root.ParentSpanID, root.Status)
+		}
+		handler, ok := findSpan(spansA, op.handler, root.TraceID)
+		if !ok {
+			t.Errorf("%s: no %s span in the trace", op.root, op.handler)
+			continue
+		}
+		if !hasAttr(handler, "peer") {
+			t.Errorf("%s: no peer on %s", op.root, op.handler)
+		}
+		phase, ok := findSpan(spansA, op.phase, root.TraceID)
+		if !ok || phase.ParentSpanID != handler.SpanID {
+			t.Errorf("%s: no %s span under %s", op.root, op.phase, op.handler)
+		}
+	}
+
+	get, _ := findSpan(spansB, "Get", "")
+	receive, ok := findSpan(spansB, "receive", get.TraceID)
+	if !ok || !hasAttr(receive, "network_wait") || !hasAttr(receive, "bytes") {
+		t.Errorf("no receive span timing the network in %+v", spansB)
+	}
+}
+
+func TestFileTracer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tracer := NewFileTracer(FileTracerOpts{Writer: buf, InstanceID: "node"})
+
+	root := tracer.Start(TraceContext{}, "root")
+	child := tracer.Start(root.Context(), "child")
+	child.SetAttrs("bytes", int64(5), "peer", "127.0.0.1:3000", "found", true)
+	child.End(errors.New("boom"))
+	child.End(nil)
+	root.End(nil)
+
+	var req otlpTraces
+	dec := json.NewDecoder(buf)
+	if err := dec.Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	rs := req.ResourceSpans[0]
+	if len(rs.Resource.Attributes) != 2 || *rs.Resource.Attributes[0].Value.StringValue != "rivulet" {
+		t.Errorf("resource: %+v", rs.Resource)
+	}
+
+	span := rs.ScopeSpans[0].Spans[0]
+	rc := root.Context()
+	if span.Name != "child" || len(span.TraceID) != 32 || len(span.SpanID) != 16 {
+		t.Errorf("span: %+v", span)
+	}
+	if want := hex.EncodeToString(rc.SpanID[:]); span.ParentSpanID != want {
+		t.Errorf("parent: have %q want %q", span.ParentSpanID, want)
+	}
+	if span.Status == nil || span.Status.Code != otlpStatusError || span.Status.Message != "boom" {
+		t.Errorf("status: %+v", span.Status)
+	}
+	if len(span.Attributes) != 3 || *span.Attributes[0].Value.IntValue != "5" || *span.Attributes[2].Value.BoolValue != true {
+		t.Errorf("attributes: %+v", span.Attributes)
+	}
+
+	// Ending a span twice only writes it once.
+	if err := dec.Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if name := req.ResourceSpans[0].ScopeSpans[0].Spans[0].Name; name != "root" {
+		t.Errorf("have %q want %q", name, "root")
+	}
+	if dec.More() {
+		t.Error("span written twice")
+	}
+}
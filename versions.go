@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every write of a key creates a new version of it. The current version is
+// held under the key itself, as it always was, and the versions it supersedes
+// are kept as they were under versionKey in a separate namespace of their
+// owner, see versionsID. Versions are numbered from the clock, bumped when
+// needed so they only ever go up: the owner is the only one writing its keys,
+// so that alone orders them even after it lost track of the last number it
+// used.
+//
+// Peers get versions in whatever order they arrive in. They keep the highest
+// as the current one and file the others away, so every replica ends up with
+// the same current version.
+
+const versionsSuffix = ".versions"
+
+// versionsID is the namespace the superseded versions of the objects of the
+// owner id are kept in.
+func versionsID(id string) string {
+	return id + versionsSuffix
+}
+
+// ownerOf returns the owner a namespace belongs to.
+func ownerOf(id string) string {
+	return strings.TrimSuffix(id, versionsSuffix)
+}
+
+// versionKey is the key version v of key goes by. Versions are zero padded so
+// they sort in order.
+func versionKey(key string, version uint64) string {
+	return fmt.Sprintf("%s@%020d", key, version)
+}
+
+func parseVersionKey(vkey string) (string, uint64, bool) {
+	i := strings.LastIndex(vkey, "@")
+	if i < 0 || len(vkey)-i-1 != 20 {
+		return vkey, 0, false
+	}
+	version, err := strconv.ParseUint(vkey[i+1:], 10, 64)
+	if err != nil {
+		return vkey, 0, false
+	}
+	return vkey[:i], version, true
+}
+
+// archiveKey is the key version v of key is filed away under. Shards of a
+// version are the shards of the versioned key, so that gathering the shards
+// of a version works the same as for the current one.
+func archiveKey(key string, version uint64) string {
+	if base, i, ok := shardOf(key); ok {
+		return shardKey(versionKey(base, version), i)
+	}
+	return versionKey(key, version)
+}
+
+// nextVersion returns the version that follows prev.
+func nextVersion(prev uint64) uint64 {
+	if now := uint64(time.Now().UnixNano()); now > prev {
+		return now
+	}
+	return prev + 1
+}
+
+// VersionPolicy tells how many of the versions superseded by a newer write
+// are kept. The zero policy keeps every one of them.
+type VersionPolicy struct {
+	// Keep is how many superseded versions of a key are kept, the newest
+	// first. Zero means no limit.
+	Keep int
+	// MaxAge is how long a superseded version is kept after it was written.
+	// Zero means forever.
+	MaxAge time.Duration
+}
+
+// settle tells how the version in of a key relates to the version cur held
+// for it: whether it is the same one, or comes after or before it. Versions
+// written concurrently are settled by the resolver, which also tells whether
+// the one not kept current is a sibling.
+func (s *FileServer) settle(in Metadata, cur Metadata) (clockOrder, bool) {
+	// Versions written before vector clocks only have their number to go by.
+	if len(in.Clock) == 0 || len(cur.Clock) == 0 {
+		switch {
+		case in.Version > cur.Version:
+			return clockAfter, false
+		case in.Version < cur.Version:
+			return clockBefore, false
+		}
+		return clockEqual, false
+	}
+
+	order := in.Clock.compare(cur.Clock)
+	if order != clockConcurrent {
+		return order, false
+	}
+
+	winner, sibling := s.Resolver(in, cur)
+	s.Logger.Info("concurrent versions conflict", "owner", cur.Owner, "key", cur.Key, "versions", []uint64{in.Version, cur.Version}, "kept", winner.Version)
+	if winner.Version == in.Version && winner.Node == in.Node {
+		return clockAfter, sibling
+	}
+	return clockBefore, sibling
+}
+
+// archive files the current version of (id, key), described by cur, away
+// among the superseded versions. It reports whether it did, as the version
+// may have been filed away already.
+func (s *FileServer) archive(id string, key string, cur Metadata) (bool, error) {
+	vid, vkey := versionsID(id), archiveKey(key, cur.Version)
+	if s.store.Has(vid, vkey) {
+		return false, nil
+	}
+
+	_, r, err := s.store.Read(id, key)
+	if err != nil {
+		return false, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	if _, err := s.store.WriteWithMeta(vid, vkey, cur, r); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unarchive takes back the version archive filed away, when the write that
+// was to supersede it failed and it is still the current one.
+func (s *FileServer) unarchive(id string, key string, cur Metadata) error {
+	return s.store.Delete(versionsID(id), archiveKey(key, cur.Version))
+}
+
+// replicaMeta returns the metadata of the newest replica of our key we hold,
+// as handed to us by another node running under our ID, or the zero
+// Metadata if there is none.
+func (s *FileServer) replicaMeta(key string) Metadata {
+	wire := s.wireKey(key)
+	if meta, err := s.store.Stat(s.ID, wire); err == nil {
+		return meta
+	}
+
+	var newest Metadata
+	for i := 0; i < s.DataShards+s.ParityShards; i++ {
+		if meta, err := s.store.Stat(s.ID, shardKey(wire, i)); err == nil && meta.Version > newest.Version {
+			newest = meta
+		}
+	}
+	return newest
+}
+
+// adopt settles the replica of one of our keys written by another node
+// running under our ID, meta being that of the replica, against the version
+// we hold of the key. Our next write of the key builds on whichever comes
+// out current, the other being filed away with the superseded versions,
+// just as our peers do.
+func (s *FileServer) adopt(meta Metadata) error {
+	m, err := s.unsealMeta(meta)
+	if err != nil {
+		// Not something we can read, such as the replica of a node holding
+		// other keys than ours.
+		s.Logger.Debug("not adopting replica", "key", meta.Key, "err", err)
+		return nil
+	}
+	name := m.Key
+	if _, _, versioned := parseVersionKey(name); versioned {
+		return nil
+	}
+	m.From, m.Checksum, m.ContentType = "", "", ""
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	id, key := s.ID, name
+	if cur, err := s.store.Stat(s.ID, name); err == nil {
+		order, sibling := s.settle(m, cur)
+		switch order {
+		case clockEqual:
+			return nil
+		case clockAfter:
+			cur.Sibling = sibling
+			if _, err := s.archive(s.ID, name, cur); err != nil {
+				return err
+			}
+		default:
+			m.Sibling = sibling
+			id, key = versionsID(s.ID), versionKey(name, m.Version)
+			if s.store.Has(id, key) {
+				return nil
+			}
+		}
+	}
+
+	_, r, err := s.store.Read(s.ID, meta.Key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	_, ref, err := s.receive(name, id, key, m, r)
+	if err != nil || ref == nil {
+		return err
+	}
+
+	// The content of convergent objects comes in its own blob, ahead of
+	// the reference to it.
+	_, br, err := s.store.Read(convergentID, ref.Blob)
+	if err != nil {
+		return fmt.Errorf("adopting (%s): %w", name, err)
+	}
+	if rc, ok := br.(io.Closer); ok {
+		defer rc.Close()
+	}
+	_, err = writeDecrypt(s.store, newMemoryKeystore(ref.Key).Key, id, key, m, br)
+	return err
+}
+
+// resolveVersion returns where the object (id, key) is held, key being either
+// a plain key or a versioned one, which is the current object if it is still
+// at that version.
+func (s *FileServer) resolveVersion(id string, key string) (string, string) {
+	base, i, shard := shardOf(key)
+	name, version, ok := parseVersionKey(base)
+	if !ok {
+		return id, key
+	}
+
+	cur := name
+	if shard {
+		cur = shardKey(name, i)
+	}
+	if meta, err := s.store.Stat(id, cur); err == nil && meta.Version == version {
+		return id, cur
+	}
+	return versionsID(id), key
+}
+
+// GetVersion returns the given version of one of our objects, fetching it
+// from the network if we don't hold it.
+func (s *FileServer) GetVersion(key string, version uint64) (io.Reader, error) {
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
+
+	span := s.Tracer.Start(TraceContext{}, "GetVersion")
+	span.SetAttrs("key", key, "version", version)
+	r, err := s.getVersion(span.Context(), key, version)
+	span.End(err)
+	return r, err
+}
+
+func (s *FileServer) getVersion(tc TraceContext, key string, version uint64) (io.Reader, error) {
+	id, vkey := s.resolveVersion(s.ID, versionKey(key, version))
+
+	if !s.has(id, vkey) {
+		s.Logger.Debug("version not held locally, fetching it from the network", "key", key, "version", version)
+
+		id, vkey = versionsID(s.ID), versionKey(key, version)
+		err := s.fetchInto(tc, key, versionKey(s.wireKey(key), version), id, vkey, Metadata{Version: version})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, r, err := s.store.Read(id, vkey)
+	return r, err
+}
+
+// Versions returns the metadata of every version held of one of our keys,
+// oldest first.
+func (s *FileServer) Versions(key string) ([]Metadata, error) {
+	res, err := s.store.List(versionsID(s.ID), ListOpts{Prefix: key + "@"})
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Metadata, 0, len(res.Entries)+1)
+	for _, meta := range res.Entries {
+		if name, _, ok := parseVersionKey(meta.Key); ok && name == key {
+			meta.Key, meta.Owner = key, s.ID
+			versions = append(versions, meta)
+		}
+	}
+	if meta, err := s.store.Stat(s.ID, key); err == nil {
+		versions = append(versions, meta)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+	return versions, nil
+}
+
+// Siblings returns the versions of one of our keys that lost a conflict but
+// were kept, see KeepSiblings, from across this node and its peers. They can
+// be read with GetVersion.
+func (s *FileServer) Siblings(key string) ([]Metadata, error) {
+	res, err := s.List(versionsID(s.ID), ListOpts{Prefix: key + "@"})
+	if err != nil {
+		return nil, err
+	}
+
+	var siblings []Metadata
+	for _, meta := range res.Entries {
+		if name, _, ok := parseVersionKey(meta.Key); ok && name == key && meta.Sibling {
+			meta.Key, meta.Owner = key, s.ID
+			siblings = append(siblings, meta)
+		}
+	}
+	return siblings, nil
+}
+
+// pruneVersions deletes the superseded versions held in the namespace id that
+// the version policy no longer keeps.
+func (s *FileServer) pruneVersions(id string, now time.Time, report *SweepReport, usage *usageLedger) error {
+	policy := s.VersionPolicy
+	if policy.Keep <= 0 && policy.MaxAge <= 0 {
+		return nil
+	}
+
+	res, err := s.store.List(id, ListOpts{})
+	if err != nil {
+		return err
+	}
+
+	// Shards of a version are pruned along with the other shards of the
+	// same index.
+	held := map[string][]Metadata{}
+	for _, meta := range res.Entries {
+		base, i, shard := shardOf(meta.Key)
+		name, _, ok := parseVersionKey(base)
+		if !ok {
+			continue
+		}
+		if shard {
+			name = shardKey(name, i)
+		}
+		held[name] = append(held[name], meta)
+	}
+
+	for _, versions := range held {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Version > versions[j].Version
+		})
+
+		pruneable := versions[:0]
+		for _, meta := range versions {
+			if !meta.Sibling {
+				pruneable = append(pruneable, meta)
+			}
+		}
+
+		for i, meta := range pruneable {
+			keep := (policy.Keep <= 0 || i < policy.Keep) &&
+				(policy.MaxAge <= 0 || now.Sub(meta.Created) < policy.MaxAge)
+			if keep {
+				continue
+			}
+
+			if err := s.store.Delete(id, meta.Key); err != nil {
+				s.Logger.Error("pruning version", "owner", id, "key", meta.Key, "err", err)
+				continue
+			}
+
+			report.Versions++
+			report.Bytes += meta.Size
+			report.Owners[ownerOf(id)]++
+
+			if ownerOf(id) != s.ID {
+				if err := usage.add(ownerOf(id), meta.From, -meta.Size); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+func TestVersions(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:       NewMemoryStore(),
+		Transport:     p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+		VersionPolicy: VersionPolicy{Keep: 1},
+	})
+
+	for i := 1; i <= 3; i++ {
+		data := fmt.Sprintf("build %d", i)
+		if err := s.Store("artifact", bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := s.Versions("artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("have %d versions want 3", len(versions))
+	}
+	for i := 1; i < len(versions); i++ {
+		if versions[i].Version <= versions[i-1].Version {
+			t.Errorf("versions out of order: %d after %d", versions[i].Version, versions[i-1].Version)
+		}
+	}
+
+	read := func(r io.Reader, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		return string(b)
+	}
+
+	if have := read(s.Get("artifact")); have != "build 3" {
+		t.Errorf("latest: have %q want %q", have, "build 3")
+	}
+	if have := read(s.GetVersion("artifact", versions[0].Version)); have != "build 1" {
+		t.Errorf("first version: have %q want %q", have, "build 1")
+	}
+	if have := read(s.GetVersion("artifact", versions[2].Version)); have != "build 3" {
+		t.Errorf("current version: have %q want %q", have, "build 3")
+	}
+
+	// Only the newest superseded version survives the policy.
+	report, err := s.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Versions != 1 {
+		t.Errorf("have %d pruned versions want 1", report.Versions)
+	}
+
+	versions, err = s.Versions("artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Checksum == versions[1].Checksum {
+		t.Errorf("have %d versions left want 2", len(versions))
+	}
+}
+
+func TestFailedOverwrite(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:   NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+
+	if err := s.Store("artifact", strings.NewReader("build 1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload that breaks off half way.
+	errBoom := errors.New("boom")
+	if err := s.Store("artifact", io.MultiReader(strings.NewReader("build"), iotest.ErrReader(errBoom))); !errors.Is(err, errBoom) {
+		t.Fatalf("have %v want %v", err, errBoom)
+	}
+
+	r, err := s.Get("artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	if string(b) != "build 1" {
+		t.Errorf("after a failed overwrite: have %q want %q", b, "build 1")
+	}
+
+	// Nor is it filed away as a previous version of itself.
+	versions, err := s.Versions("artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("have %d versions want 1", len(versions))
+	}
+
+	// The next write builds on it as if nothing happened.
+	if err := s.Store("artifact", strings.NewReader("build 2")); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := s.Versions("artifact"); len(versions) != 2 || versions[1].Version <= versions[0].Version {
+		t.Errorf("versions after the next write: %+v", versions)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	var (
+		key  = newEncryptionKey()
+		errs []chan error
+	)
+	start := func(s *FileServer) {
+		errc := make(chan error, 1)
+		go func() { errc <- s.Start() }()
+		errs = append(errs, errc)
+		time.Sleep(50 * time.Millisecond)
+	}
+	// x and y are two nodes of the same owner, z a peer of both.
+	writer := func(bootstrap ...string) *FileServer {
+		s := newTestNode(t, freeAddr(t), nil, bootstrap...)
+		s.ID = "owner"
+		s.keys = newMemoryKeystore(key)
+		return s
+	}
+
+	x := writer()
+	start(x)
+	y := writer(x.Transport.Addr())
+	start(y)
+	z := newTestNode(t, freeAddr(t), nil, x.Transport.Addr(), y.Transport.Addr())
+	start(z)
+	waitFor(t, "the nodes to connect", func() bool {
+		return len(x.Peers()) == 2 && len(y.Peers()) == 2 && len(z.Peers()) == 2
+	})
+
+	read := func(s *FileServer) string {
+		_, r, err := s.store.Read(s.ID, "doc")
+		if err != nil {
+			return err.Error()
+		}
+		b, _ := io.ReadAll(r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		return string(b)
+	}
+	current := func(s *FileServer, id string, key string) Metadata {
+		meta, _ := s.store.Stat(id, key)
+		return meta
+	}
+
+	var wg sync.WaitGroup
+	for _, w := range []*FileServer{x, y} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.Store("doc", strings.NewReader("from "+w.NodeID)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Both writers settle on the same version as their peer does.
+	wire := x.wireKey("doc")
+	waitFor(t, "the writers to agree", func() bool {
+		held := current(z, "owner", wire)
+		return held.Node != "" &&
+			current(x, x.ID, "doc").Node == held.Node &&
+			current(y, y.ID, "doc").Node == held.Node &&
+			read(x) == read(y)
+	})
+	var versions []Metadata
+	for _, w := range []*FileServer{x, y} {
+		if versions, _ = w.Versions("doc"); len(versions) != 2 {
+			t.Errorf("%s holds %d versions want both", w.NodeID, len(versions))
+		}
+	}
+
+	// A write following it knows of both, and supersedes them everywhere.
+	if err := y.Store("doc", strings.NewReader("after")); err != nil {
+		t.Fatal(err)
+	}
+	latest := current(y, y.ID, "doc")
+	for _, v := range versions {
+		if latest.Clock.compare(v.Clock) != clockAfter {
+			t.Errorf("clock of the next write %v does not follow %v", latest.Clock, v.Clock)
+		}
+	}
+	waitFor(t, "the next write everywhere", func() bool {
+		return current(z, "owner", wire).Version == latest.Version && read(x) == "after"
+	})
+
+	for _, s := range []*FileServer{z, y, x} {
+		s.Stop()
+	}
+	for _, errc := range errs {
+		if err := <-errc; err != nil {
+			t.Errorf("start returned %v", err)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// The WebDAV export shows the keys of a node as a directory tree, splitting
+// them on slashes, so that any file manager can browse, read, write and delete
+// them. Directories only exist as long as keys are held under them, except for
+// those made explicitly, which are kept as an empty object under the name of
+// the directory followed by a slash, the way S3 tools do it.
+
+type WebDAVOpts struct {
+	// ListenAddr is the address the export is served on.
+	ListenAddr string
+	Server     *FileServer
+	// Username and Password are what clients have to authenticate with, over
+	// HTTP basic authentication. When they are left empty anyone can connect,
+	// and ListenAddr has to be a loopback address.
+	Username string
+	Password string
+	// Logger is what the export logs to, nothing when left nil.
+	Logger *slog.Logger
+}
+
+// WebDAV serves the objects of a FileServer over WebDAV.
+type WebDAV struct {
+	WebDAVOpts
+
+	handler *webdav.Handler
+	srv     *http.Server
+
+	addrLock sync.Mutex
+	addr     net.Addr
+}
+
+func NewWebDAV(opts WebDAVOpts) *WebDAV {
+	if opts.Logger == nil {
+		opts.Logger = discardLogger()
+	}
+
+	d := &WebDAV{
+		WebDAVOpts: opts,
+		handler: &webdav.Handler{
+			FileSystem: &davFS{s: opts.Server},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					opts.Logger.Error("webdav request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+				}
+			},
+		},
+	}
+	d.srv = &http.Server{Handler: d}
+	return d
+}
+
+func (d *WebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.Username != "" || d.Password != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(d.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(d.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rivulet"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	d.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on ListenAddr and serves requests until Close is
+// called.
+func (d *WebDAV) ListenAndServe() error {
+	if d.Username == "" && d.Password == "" {
+		if err := checkLoopback(d.ListenAddr); err != nil {
+			return fmt.Errorf("webdav without credentials: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", d.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	d.addrLock.Lock()
+	d.addr = ln.Addr()
+	d.addrLock.Unlock()
+
+	err = d.srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Addr returns the address the export listens on, nil until it does.
+func (d *WebDAV) Addr() net.Addr {
+	d.addrLock.Lock()
+	defer d.addrLock.Unlock()
+	return d.addr
+}
+
+func (d *WebDAV) Close() error {
+	return d.srv.Close()
+}
+
+// davFS is the key namespace of a FileServer as a webdav.FileSystem.
+type davFS struct {
+	s *FileServer
+}
+
+// davKey returns the key a WebDAV path stands for, the root being the empty
+// key.
+func davKey(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// dirPrefix returns the prefix of every key under the directory key.
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+// under returns the metadata of every key under the directory key, its own
+// marker included.
+func (d *davFS) under(key string, limit int) ([]Metadata, error) {
+	var (
+		entries []Metadata
+		opts    = ListOpts{Prefix: dirPrefix(key), Limit: limit}
+	)
+	for {
+		res, err := d.s.List(d.s.ID, opts)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, res.Entries...)
+		if res.Next == "" || (limit > 0 && len(entries) >= limit) {
+			return entries, nil
+		}
+		opts.After = res.Next
+	}
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	key := davKey(name)
+	if key == "" {
+		return &davInfo{name: "/", dir: true}, nil
+	}
+
+	if meta, err := d.s.Stat(key); err == nil && !meta.expired(time.Now()) {
+		return &davInfo{name: key, meta: meta}, nil
+	}
+
+	// Keys we don't hold ourselves, and directories, only show up in
+	// listings.
+	entries, err := d.under(key, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return &davInfo{name: key, dir: true}, nil
+	}
+
+	res, err := d.s.List(d.s.ID, ListOpts{Prefix: key, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) > 0 && res.Entries[0].Key == key {
+		return &davInfo{name: key, meta: res.Entries[0]}, nil
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	key := davKey(name)
+	if _, err := d.Stat(ctx, name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if parent := path.Dir("/" + key); parent != "/" {
+		info, err := d.Stat(ctx, parent)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("parent is not a directory")}
+		}
+	}
+
+	return d.s.Store(key+"/", strings.NewReader(""))
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	key := davKey(name)
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if key == "" {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+		}
+		if info, err := d.Stat(ctx, name); err == nil && info.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		tmp, err := os.CreateTemp("", "rvt-webdav-*")
+		if err != nil {
+			return nil, err
+		}
+		return &davWriter{s: d.s, key: key, tmp: tmp}, nil
+	}
+
+	info, err := d.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &davDir{fs: d, key: key, info: info}, nil
+	}
+	return &davFile{s: d.s, key: key, info: info.(*davInfo)}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	key := davKey(name)
+	if key == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+
+	entries, err := d.under(key, 0)
+	if err != nil {
+		return err
+	}
+	for _, meta := range entries {
+		if err := d.s.Delete(meta.Key); err != nil {
+			return err
+		}
+	}
+	return d.s.Delete(key)
+}
+
+// Rename moves a key, or every key under a directory, by copying it over to
+// its new name and deleting the old one.
+func (d *davFS) Rename(ctx context.Context, oldName string, newName string) error {
+	from, to := davKey(oldName), davKey(newName)
+	if from == "" || to == "" {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+	}
+
+	info, err := d.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return d.move(from, to)
+	}
+
+	entries, err := d.under(from, 0)
+	if err != nil {
+		return err
+	}
+	for _, meta := range entries {
+		if err := d.move(meta.Key, dirPrefix(to)+strings.TrimPrefix(meta.Key, dirPrefix(from))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *davFS) move(from string, to string) error {
+	r, err := d.s.Get(from)
+	if err != nil {
+		return err
+	}
+	err = d.s.Store(to, r)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return d.s.Delete(from)
+}
+
+// davInfo describes a key, or a directory of keys.
+type davInfo struct {
+	name string
+	meta Metadata
+	dir  bool
+}
+
+func (i *davInfo) Name() string       { return path.Base(i.name) }
+func (i *davInfo) Size() int64        { return i.meta.Size }
+func (i *davInfo) ModTime() time.Time { return i.meta.Created }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() any           { return nil }
+
+func (i *davInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *davInfo) ETag(ctx context.Context) (string, error) {
+	if i.dir || i.meta.Checksum == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return etag(i.meta), nil
+}
+
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.dir || i.meta.ContentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.meta.ContentType, nil
+}
+
+// davFile reads a key. Objects are streamed rather than read whole: seeking
+// only moves the offset, and the object is read up to it, from the start
+// again if need be, on the next read.
+type davFile struct {
+	s    *FileServer
+	key  string
+	info *davInfo
+
+	r   io.Reader
+	pos int64
+	off int64
+}
+
+func (f *davFile) Read(b []byte) (int, error) {
+	if f.r == nil || f.off < f.pos {
+		f.closeReader()
+		r, err := f.s.Get(f.key)
+		if err != nil {
+			return 0, err
+		}
+		f.r, f.pos = r, 0
+	}
+	if f.off > f.pos {
+		n, err := io.CopyN(io.Discard, f.r, f.off-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.r.Read(b)
+	f.pos += int64(n)
+	f.off = f.pos
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *davFile) closeReader() {
+	if rc, ok := f.r.(io.Closer); ok {
+		rc.Close()
+	}
+	f.r = nil
+}
+
+func (f *davFile) Close() error {
+	f.closeReader()
+	return nil
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.key, Err: errors.New("not a directory")}
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *davFile) Write(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.key, Err: fs.ErrPermission}
+}
+
+// davWriter collects what is written to a key in a temporary file, and
+// stores it once closed.
+type davWriter struct {
+	s   *FileServer
+	key string
+	tmp *os.File
+}
+
+func (w *davWriter) Write(b []byte) (int, error) {
+	return w.tmp.Write(b)
+}
+
+func (w *davWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.s.Store(w.key, w.tmp)
+}
+
+func (w *davWriter) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.key, Err: fs.ErrPermission}
+}
+
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return w.tmp.Seek(offset, whence)
+}
+
+func (w *davWriter) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: w.key, Err: errors.New("not a directory")}
+}
+
+func (w *davWriter) Stat() (fs.FileInfo, error) {
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &davInfo{name: w.key, meta: Metadata{Key: w.key, Size: info.Size(), Created: info.ModTime()}}, nil
+}
+
+// davDir lists the keys right under a directory, and the directories their
+// names imply.
+type davDir struct {
+	fs   *davFS
+	key  string
+	info os.FileInfo
+
+	children []fs.FileInfo
+	listed   bool
+}
+
+func (d *davDir) list() error {
+	entries, err := d.fs.under(d.key, 0)
+	if err != nil {
+		return err
+	}
+
+	prefix := dirPrefix(d.key)
+	seen := map[string]bool{}
+	now := time.Now()
+	for _, meta := range entries {
+		rest := strings.TrimPrefix(meta.Key, prefix)
+		if rest == "" || meta.expired(now) {
+			continue
+		}
+
+		if child, _, dir := strings.Cut(rest, "/"); dir {
+			if !seen[child] {
+				seen[child] = true
+				d.children = append(d.children, &davInfo{name: prefix + child, dir: true})
+			}
+			continue
+		}
+		d.children = append(d.children, &davInfo{name: meta.Key, meta: meta})
+	}
+
+	d.listed = true
+	return nil
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		if err := d.list(); err != nil {
+			return nil, err
+		}
+	}
+
+	if count <= 0 {
+		children := d.children
+		d.children = nil
+		return children, nil
+	}
+	if len(d.children) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.children))
+	children := d.children[:n]
+	d.children = d.children[n:]
+	return children, nil
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.key, Err: errors.New("is a directory")}
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: d.key, Err: errors.New("is a directory")}
+}
+
+func (d *davDir) Write(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.key, Err: errors.New("is a directory")}
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
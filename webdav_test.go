@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kurocifer/rivulet/p2p"
+)
+
+func TestWebDAV(t *testing.T) {
+	s := NewFileServer(FileServerOPts{
+		Storage:   NewMemoryStore(),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":0"}),
+	})
+	ts := httptest.NewServer(NewWebDAV(WebDAVOpts{Server: s, Username: "designer", Password: "secret"}))
+	defer ts.Close()
+
+	do := func(method string, path string, body string, header ...string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("designer", "secret")
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+	expect := func(resp *http.Response, status int) {
+		t.Helper()
+		if resp.StatusCode != status {
+			t.Errorf("%s %s: have status %d want %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expect(resp, http.StatusUnauthorized)
+
+	resp, _ = do("MKCOL", "/mockups", "")
+	expect(resp, http.StatusCreated)
+	resp, _ = do(http.MethodPut, "/mockups/home.svg", "<svg>home</svg>")
+	expect(resp, http.StatusCreated)
+	resp, _ = do(http.MethodPut, "/brand/logo.svg", "<svg>logo</svg>")
+	expect(resp, http.StatusCreated)
+
+	// The root lists both directories, one made explicitly and one implied
+	// by the keys under it.
+	resp, body := do("PROPFIND", "/", "", "Depth", "1")
+	expect(resp, http.StatusMultiStatus)
+	for _, want := range []string{"/mockups/", "/brand/"} {
+		if !strings.Contains(body, "<D:href>"+want+"</D:href>") {
+			t.Errorf("listing of / is missing %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "home.svg") {
+		t.Errorf("listing of / goes deeper than its children:\n%s", body)
+	}
+
+	resp, body = do(http.MethodGet, "/mockups/home.svg", "", "Range", "bytes=5-8")
+	expect(resp, http.StatusPartialContent)
+	if body != "home" {
+		t.Errorf("range: have %q want %q", body, "home")
+	}
+
+	resp, _ = do("MOVE", "/mockups", "", "Destination", ts.URL+"/archive/mockups")
+	expect(resp, http.StatusCreated)
+	resp, body = do(http.MethodGet, "/archive/mockups/home.svg", "")
+	expect(resp, http.StatusOK)
+	if body != "<svg>home</svg>" {
+		t.Errorf("moved file: have %q", body)
+	}
+	resp, _ = do(http.MethodGet, "/mockups/home.svg", "")
+	expect(resp, http.StatusNotFound)
+
+	resp, _ = do(http.MethodDelete, "/brand", "")
+	expect(resp, http.StatusNoContent)
+	if _, err := s.Stat("brand/logo.svg"); err == nil {
+		t.Error("deleting a directory left the keys under it")
+	}
+}